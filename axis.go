@@ -5,6 +5,8 @@
 package xpath
 
 import (
+	"fmt"
+
 	"github.com/santhosh-tekuri/dom"
 )
 
@@ -15,6 +17,11 @@ type Iterator interface {
 	Next() dom.Node
 }
 
+// AxisNS is the namespace uri of the extension axes registered
+// with Compiler.Axes. Calling a function in this namespace
+// selects the nodes along the axis of that name.
+const AxisNS = "https://github.com/santhosh-tekuri/xpath/axis"
+
 var iterators = []func(dom.Node) Iterator{
 	ChildAxis,
 	DescendantAxis,
@@ -99,16 +106,20 @@ func FollowingSiblingAxis(n dom.Node) Iterator {
 // This is forward axis.
 func NamespaceAxis(n dom.Node) Iterator {
 	if elem, ok := n.(*dom.Element); ok {
-		m := make(map[string]struct{})
+		// nearest declaration of a prefix wins. empty uri undeclares
+		// the prefix, so it is remembered but not added.
+		m := map[string]struct{}{"xml": {}}
 		ns := []dom.Node{
-			&dom.NameSpace{elem, "xml", "http://www.w3.org/XML/1998/namespace"},
+			&dom.NameSpace{Owner: elem, Prefix: "xml", URI: "http://www.w3.org/XML/1998/namespace"},
 		}
 		e := elem
 		for {
 			for prefix, uri := range e.NSDecl {
 				if _, ok := m[prefix]; !ok {
 					m[prefix] = struct{}{}
-					ns = append(ns, &dom.NameSpace{elem, prefix, uri})
+					if uri != "" {
+						ns = append(ns, &dom.NameSpace{Owner: elem, Prefix: prefix, URI: uri})
+					}
 				}
 			}
 			p := e.Parent()
@@ -240,37 +251,57 @@ func (iter *ancestorOrSelfIter) Next() dom.Node {
 //
 // This is forward axis.
 func DescendantAxis(n dom.Node) Iterator {
-	return &descendantIter{nil, ChildAxis(n)}
+	iter := &descendantIter{}
+	iter.stack = iter.buf[:0]
+	iter.push(n)
+	return iter
 }
 
 // DescendantOrSelfAxis returns Iterator which contains the context node and the descendants of the context node.
 //
 // This is forward axis.
 func DescendantOrSelfAxis(n dom.Node) Iterator {
-	return &descendantIter{nil, SelfAxis(n)}
+	iter := &descendantIter{self: n}
+	iter.stack = iter.buf[:0]
+	return iter
 }
 
+// descendantIter walks the subtree in document order. It keeps
+// a stack of the unvisited siblings at each level, which are
+// subslices of Children(). So it does not allocate per node.
 type descendantIter struct {
-	stack    []Iterator
-	children Iterator
+	self  dom.Node
+	stack [][]dom.Node
+	buf   [8][]dom.Node
 }
 
-func (iter *descendantIter) Next() dom.Node {
-	var n dom.Node
-	for {
-		n = iter.children.Next()
-		if n != nil {
-			break
+func (iter *descendantIter) push(n dom.Node) {
+	if p, ok := n.(dom.Parent); ok {
+		if children := p.Children(); len(children) > 0 {
+			iter.stack = append(iter.stack, children)
 		}
-		if len(iter.stack) == 0 {
-			return nil
+	}
+}
+
+func (iter *descendantIter) Next() dom.Node {
+	if n := iter.self; n != nil {
+		iter.self = nil
+		iter.push(n)
+		return n
+	}
+	for len(iter.stack) > 0 {
+		top := len(iter.stack) - 1
+		siblings := iter.stack[top]
+		if len(siblings) == 0 {
+			iter.stack = iter.stack[:top]
+			continue
 		}
-		iter.children = iter.stack[len(iter.stack)-1]
-		iter.stack = iter.stack[:len(iter.stack)-1]
+		n := siblings[0]
+		iter.stack[top] = siblings[1:]
+		iter.push(n)
+		return n
 	}
-	iter.stack = append(iter.stack, iter.children)
-	iter.children = ChildAxis(n)
-	return n
+	return nil
 }
 
 /************************************************************************/
@@ -280,7 +311,17 @@ func (iter *descendantIter) Next() dom.Node {
 // excluding attribute nodes and namespace nodes.
 //
 // This is forward axis.
+//
+// For attribute and namespace nodes, it contains the descendants of their
+// element, followed by the nodes following their element.
 func FollowingAxis(n dom.Node) Iterator {
+	if !isChild(n) {
+		owner := Parent(n)
+		if owner == nil {
+			return emptyIter{}
+		}
+		return &followingIter{AncestorOrSelfAxis(owner), emptyIter{}, DescendantAxis(owner)}
+	}
 	return &followingIter{AncestorOrSelfAxis(n), emptyIter{}, emptyIter{}}
 }
 
@@ -386,10 +427,128 @@ func childrenOrSelfIter(n dom.Node) *reverseIter {
 func Parent(n dom.Node) dom.Node {
 	switch n := n.(type) {
 	case *dom.Attr:
+		if n.Owner == nil {
+			return nil
+		}
 		return n.Owner
 	case *dom.NameSpace:
+		if n.Owner == nil {
+			return nil
+		}
 		return n.Owner
 	default:
 		return n.Parent()
 	}
 }
+
+// IndexOf returns the 1-based position of the node among the children
+// of its parent. It returns -1, if the node is a document, attribute or
+// namespace node, which are not children of any node.
+//
+// Use it with *XPath.EvalNodeSet, whose result is in document order,
+// to find where the selected nodes are.
+func IndexOf(n dom.Node) int {
+	if !isChild(n) {
+		return -1
+	}
+	p := n.Parent()
+	if p == nil {
+		return -1
+	}
+	for i, c := range p.Children() {
+		if c == n {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// NodePath returns the location path from root to the given node,
+// like /a/b[2]/@c or /a/text()[3]. Each step has positional predicate,
+// except attribute and namespace steps. Element, attribute and
+// processing-instruction names are as used in the document.
+// So the path selects the node only if the prefixes used in
+// the document are bound to same namespaces when evaluating it.
+//
+// If the node is not part of a document, the path is relative to the
+// topmost ancestor of the node, like b[1]/@c, and is "." for that
+// ancestor itself.
+func NodePath(n dom.Node) string {
+	return nodePath(n, func(name *dom.Name) string {
+		return name.String()
+	})
+}
+
+// nodePath returns the location path from root to the node,
+// using qname to format element and attribute names.
+func nodePath(n dom.Node, qname func(*dom.Name) string) string {
+	// position returns the position of n among its siblings,
+	// for which same returns true. The n must have parent.
+	position := func(n dom.Node, same func(dom.Node) bool) int {
+		pos := 0
+		for _, c := range n.Parent().Children() {
+			if same(c) {
+				pos++
+			}
+			if c == n {
+				break
+			}
+		}
+		return pos
+	}
+
+	var arr []string
+	for {
+		p := Parent(n)
+		if p == nil {
+			break
+		}
+		switch x := n.(type) {
+		case *dom.Element:
+			pos := position(x, func(c dom.Node) bool {
+				e, ok := c.(*dom.Element)
+				return ok && e.URI == x.URI && e.Local == x.Local
+			})
+			arr = append(arr, fmt.Sprintf("%s[%d]", qname(x.Name), pos))
+		case *dom.Attr:
+			arr = append(arr, "@"+qname(x.Name))
+		case *dom.Text:
+			pos := position(x, isText)
+			arr = append(arr, fmt.Sprintf("text()[%d]", pos))
+		case *dom.Comment:
+			pos := position(x, isComment)
+			arr = append(arr, fmt.Sprintf("comment()[%d]", pos))
+		case *dom.ProcInst:
+			pos := position(x, isProcInst(x.Target))
+			arr = append(arr, fmt.Sprintf("processing-instruction(%q)[%d]", x.Target, pos))
+		case *dom.NameSpace:
+			arr = append(arr, fmt.Sprintf("namespace::%s", x.Prefix))
+		default:
+			pos := position(x, alwaysTrue)
+			arr = append(arr, fmt.Sprintf("node()[%d]", pos))
+		}
+		n = p
+	}
+
+	path := ""
+	if _, ok := n.(*dom.Document); ok {
+		for i := len(arr) - 1; i >= 0; i-- {
+			path += "/" + arr[i]
+		}
+		if path == "" {
+			path = "/"
+		}
+		return path
+	}
+	// relative to root of detached tree
+	for i := len(arr) - 1; i >= 0; i-- {
+		if path != "" {
+			path += "/"
+		}
+		path += arr[i]
+	}
+	if path == "" {
+		path = "."
+	}
+	return path
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Santhosh Kumar Tekuri. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xpath
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Collation defines how strings are compared by the functions
+// starts-with, ends-with, contains and by the operators = and !=.
+//
+// By default strings are compared exactly, codepoint by codepoint.
+type Collation interface {
+	// Compare returns an integer comparing two strings.
+	// The result will be 0 if a==b, -1 if a < b, and +1 if a > b.
+	Compare(a, b string) int
+
+	// HasPrefix tells whether the string s begins with prefix.
+	HasPrefix(s, prefix string) bool
+
+	// HasSuffix tells whether the string s ends with suffix.
+	HasSuffix(s, suffix string) bool
+
+	// Contains tells whether substr is within s.
+	Contains(s, substr string) bool
+}
+
+// CaseInsensitive is a Collation that compares strings
+// under simple Unicode case-folding.
+var CaseInsensitive Collation = caseInsensitive{}
+
+type caseInsensitive struct{}
+
+func (caseInsensitive) Compare(a, b string) int {
+	return strings.Compare(foldCase(a), foldCase(b))
+}
+
+func (caseInsensitive) HasPrefix(s, prefix string) bool {
+	return strings.HasPrefix(foldCase(s), foldCase(prefix))
+}
+
+func (caseInsensitive) HasSuffix(s, suffix string) bool {
+	return strings.HasSuffix(foldCase(s), foldCase(suffix))
+}
+
+func (caseInsensitive) Contains(s, substr string) bool {
+	return strings.Contains(foldCase(s), foldCase(substr))
+}
+
+func foldCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		return unicode.ToLower(unicode.ToUpper(r))
+	}, s)
+}
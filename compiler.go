@@ -5,8 +5,11 @@
 package xpath
 
 import (
+	"bytes"
 	"fmt"
 	"math"
+	"math/rand"
+	"strings"
 
 	"github.com/santhosh-tekuri/dom"
 	xpath "github.com/santhosh-tekuri/xpathparser"
@@ -18,7 +21,185 @@ type Compiler struct {
 	Namespaces map[string]string
 
 	// Functions gives access to set of user defined functions.
+	// These take precedence over built-in functions of same name.
 	Functions Functions
+
+	// DefaultElementNamespace, if not empty, is the namespace uri used
+	// for unprefixed element name tests. Unprefixed attribute name tests
+	// are not affected.
+	//
+	// Note that this deviates from XPath 1.0, where unprefixed
+	// name tests always refer to no namespace.
+	DefaultElementNamespace string
+
+	// DynamicFunctions, if not nil, is consulted for functions that
+	// cannot be resolved during compilation. Such functions are resolved
+	// each time the expression is evaluated, so they can be registered
+	// after compilation. The trade-off is that their arguments are
+	// validated and converted at evaluation time rather than at compile time.
+	DynamicFunctions Functions
+
+	// RandSource, if not nil, is the source of random numbers
+	// used by math:random(). Use it with fixed seed to get reproducible
+	// evaluations. It defaults to time-seeded source.
+	//
+	// The source must be safe for concurrent use, if compiled xpaths
+	// are evaluated concurrently.
+	RandSource rand.Source
+
+	// Collation, if not nil, is used to compare strings by the
+	// functions starts-with, ends-with, contains and by the
+	// operators = and !=. It is captured at compile time.
+	Collation Collation
+
+	// BaseURI is the base uri of the document, against which the
+	// xml:base attributes are resolved by base-uri().
+	BaseURI string
+
+	// StripWhitespace, if true, makes text nodes consisting solely of
+	// whitespace invisible to the node tests text() and node(), like
+	// xsl:strip-space. This is useful when querying indented documents,
+	// where such text nodes affect position() and count().
+	//
+	// This applies to all axes including self. So if context node is such
+	// text node, self::node() and its abbreviation . select nothing, and
+	// ancestor-or-self::node() selects only the ancestors.
+	//
+	// Like xsl:strip-space, the text nodes within the scope of
+	// xml:space="preserve" are never stripped. The scope is decided by
+	// the nearest ancestor with xml:space attribute, so xml:space="default"
+	// within such scope enables stripping again.
+	StripWhitespace bool
+
+	// StripWhitespaceElements, if not empty, limits StripWhitespace to
+	// the text nodes whose parent element has one of these names. Names
+	// are qualified names whose prefixes are resolved using Namespaces.
+	StripWhitespaceElements []string
+
+	// DefaultLang, if not empty, is the language used by lang(),
+	// when neither the context node nor its ancestors have
+	// xml:lang attribute.
+	DefaultLang string
+
+	// OnWarning, if not nil, is called during compilation for each
+	// location step that can never select any node. The patterns
+	// detected are:
+	//   - text(), comment() or processing-instruction() test
+	//     on attribute or namespace axis, like @x/attribute::text()
+	//   - child, descendant, attribute or namespace axis after
+	//     a step that selects only attribute, namespace, text,
+	//     comment or processing-instruction nodes, like text()/@x
+	OnWarning func(msg string)
+
+	// MaxNodesVisited, if positive, limits the number of nodes visited
+	// by location steps during a single evaluation. If exceeded, the
+	// evaluation fails with BudgetExceededError. Use it to protect from
+	// pathological expressions like //*[.//*[.//*]], when evaluating
+	// untrusted xpaths.
+	MaxNodesVisited int
+
+	// Axes gives access to user defined axes. Since the xpath grammar
+	// allows only built-in axes in location steps, an axis is used
+	// by calling the function of same name in AxisNS. For example
+	// with prefix axis bound to AxisNS:
+	//
+	//	axis:name()     selects nodes along the axis from context node
+	//	axis:name(expr) selects nodes along the axis from each node of expr
+	//
+	// The nodes are selected as if by a location step with node() test,
+	// and are in document order.
+	Axes map[string]func(dom.Node) Iterator
+
+	// InternNames, if not nil, must return the string the dom uses for
+	// the given uri or local name. The name tests then use the returned
+	// strings, so that comparing them with element and attribute names
+	// sharing the same bytes does not read their content. This helps
+	// when the documents being queried are built with names interned by
+	// the same function. Other documents still give correct results.
+	InternNames func(s string) string
+
+	// AllowedAxes, if not nil, is the set of axes that can be used
+	// in location steps, like "child" or "attribute". Compilation fails
+	// with DisallowedAxisError, if any other axis is used. Note that
+	// abbreviations are expanded: // uses descendant-or-self, . uses
+	// self, .. uses parent and @ uses attribute axis.
+	AllowedAxes map[string]bool
+
+	// AttributeOrder is the relative order of attributes of an element
+	// in node-sets, which xpath 1.0 leaves implementation-defined.
+	// It is one of AttrNameOrder and AttrDocumentOrder. Empty value means
+	// AttrNameOrder. Any other value fails compilation with
+	// AttributeOrderError.
+	AttributeOrder AttributeOrder
+
+	// StrictNumeric, if true, makes the div and mod operators fail with
+	// DivideByZeroError when the divisor is zero, rather than return
+	// Infinity or NaN as xpath 1.0 requires. If both operands are literals,
+	// the error is reported by Compile.
+	StrictNumeric bool
+
+	// DetectMutation, if true, makes the evaluation fail with
+	// ConcurrentModificationError, if the document is modified by
+	// another goroutine during evaluation. It records the number of
+	// children and attributes of each node visited by location steps,
+	// and checks them again at the end of evaluation. So modifications
+	// that do not add or remove nodes, like changing text, are not
+	// detected. This costs a map entry per node visited, so enable it
+	// only if the document may be shared with writers.
+	//
+	// Note that it is not a substitute for synchronization, because
+	// a modification during evaluation is still a data race.
+	DetectMutation bool
+
+	// MaxRangeSize limits the number of nodes returned by the
+	// extension function range. If exceeded, the evaluation fails
+	// with RangeSizeError. If zero, the limit is 10000.
+	MaxRangeSize int
+
+	// MaxPaddingLength limits the length of string returned by the
+	// EXSLT function str:padding. If exceeded, the evaluation fails
+	// with PaddingLengthError. If zero, the limit is 1048576.
+	MaxPaddingLength int
+
+	// BooleanStrings, if not empty, gives the strings for false and
+	// true, used when boolean is converted to string, for example by
+	// string(@a = 1) or *XPath.EvalString. If empty, they are "false"
+	// and "true" as xpath 1.0 requires. Note that the package function
+	// Value2String and Result.String are not affected.
+	BooleanStrings [2]string
+
+	// StrictFunctions, if true, verifies that the functions from
+	// Functions and DynamicFunctions return values of the DataType,
+	// their compiled expression declares. If not, evaluation fails
+	// with ReturnTypeError. If the function call is evaluated at
+	// compile time, because its arguments are literals, the error
+	// is reported by Compile. Use it to catch bugs in user defined
+	// functions during development and testing.
+	StrictFunctions bool
+
+	// NoSimplify, if true, skips the simplification of compiled
+	// expression, like folding of literal subexpressions and rewriting
+	// of logical expressions. Since simplification does not change the
+	// result, this is useful only for debugging. Note that errors like
+	// DivideByZeroError, which Compile reports when the subexpression
+	// is folded, are then reported by evaluation. It also applies to the
+	// key expression of ext:sort. But the arguments, that must be literal
+	// strings, like the key of ext:sort, are still folded to check them.
+	NoSimplify bool
+
+	// MaxDepth, if positive, limits the nesting depth of the expression.
+	// If exceeded, compilation fails with TooDeepError. Use it to protect
+	// from pathological expressions like -(-(-(...))) or ((((...)))), when
+	// compiling untrusted xpaths.
+	//
+	// The parentheses and brackets nested deeper than MaxDepth are rejected
+	// before parsing. Then the depth of compiled expression tree is checked:
+	// the depth of a literal, variable or location path without predicates
+	// is 1, and operands, arguments and predicates are one level deeper than
+	// their expression. Note that chains of operators like a or b or c are
+	// parsed recursively, and are only checked after parsing. So limit the
+	// length of untrusted xpaths too.
+	MaxDepth int
 }
 
 // Compile compiles given xpath 1.0 expression, if successful
@@ -26,17 +207,145 @@ type Compiler struct {
 //
 // Namespace prefixes and functions are resolved during compilation.
 func (c *Compiler) Compile(str string) (x *XPath, err error) {
-	defer func() {
-		panic2error(recover(), &err)
-	}()
+	if c.MaxDepth > 0 && nesting(str) > c.MaxDepth {
+		return nil, TooDeepError(c.MaxDepth)
+	}
 	expr, err := xpath.Parse(str)
 	if err != nil {
 		return nil, err
 	}
-	return &XPath{str, Simplify(c.compile(expr))}, nil
+	return c.compileXPath(str, expr)
+}
+
+// CompileExpr compiles the xpath 1.0 expression already parsed with
+// github.com/santhosh-tekuri/xpathparser. This avoids parsing again,
+// when the parsed expression is also used for other purposes.
+//
+// The String of returned XPath is the string form of given expression.
+func (c *Compiler) CompileExpr(e xpath.Expr) (x *XPath, err error) {
+	return c.compileXPath(fmt.Sprint(e), e)
+}
+
+func (c *Compiler) compileXPath(str string, e xpath.Expr) (x *XPath, err error) {
+	defer func() {
+		panic2error(recover(), &err)
+	}()
+	switch c.AttributeOrder {
+	case "", AttrNameOrder, AttrDocumentOrder:
+	default:
+		return nil, AttributeOrderError(c.AttributeOrder)
+	}
+	expr := c.compile(e, 1)
+	if !c.NoSimplify {
+		expr = Simplify(expr)
+	}
+	x = &XPath{
+		str:  str,
+		expr: expr,
+		ast:  e,
+		opts: c.evalOptions(),
+		canon: canonicalizer{
+			namespaces:       c.Namespaces,
+			defaultNamespace: c.DefaultElementNamespace,
+		},
+	}
+	x.tags = &tagCompiler{compiler: *c}
+	return x, nil
 }
 
-func (c *Compiler) compile(e xpath.Expr) Expr {
+func (c *Compiler) evalOptions() evalOptions {
+	return evalOptions{
+		maxNodes:       c.MaxNodesVisited,
+		attrDocOrder:   c.AttributeOrder == AttrDocumentOrder,
+		detectMutation: c.DetectMutation,
+		booleanStrings: c.BooleanStrings,
+	}
+}
+
+// AttributeOrder is the relative order of attributes of an element in node-sets.
+type AttributeOrder string
+
+const (
+	// AttrNameOrder orders attributes by qualified name.
+	AttrNameOrder AttributeOrder = "name"
+
+	// AttrDocumentOrder orders attributes as declared in the element.
+	AttrDocumentOrder AttributeOrder = "document"
+)
+
+// WithDocumentNamespaces returns a copy of the compiler, whose Namespaces
+// has the namespace prefixes in scope on the root element of doc, along
+// with the xml prefix. So the prefixes used in document can be used in
+// xpath, without restating them. The entries in c.Namespaces override
+// those of document. The default namespace of document is not imported,
+// because unprefixed names in xpath always mean no namespace. Use
+// DefaultElementNamespace for that.
+//
+// Note that only the prefixes in scope on root element are imported.
+// The prefixes declared by descendants of root element are not.
+func (c *Compiler) WithDocumentNamespaces(doc *dom.Document) *Compiler {
+	cc := *c
+	cc.Namespaces = make(map[string]string)
+	if root := doc.RootElement(); root != nil {
+		iter := NamespaceAxis(root)
+		for n := iter.Next(); n != nil; n = iter.Next() {
+			if ns := n.(*dom.NameSpace); ns.Prefix != "" {
+				cc.Namespaces[ns.Prefix] = ns.URI
+			}
+		}
+	}
+	for prefix, uri := range c.Namespaces {
+		cc.Namespaces[prefix] = uri
+	}
+	return &cc
+}
+
+// CompileBatch compiles each of the given xpath 1.0 expressions.
+// It returns the error of first expression that fails to compile.
+//
+// The compiled xpaths can be evaluated together using BatchEval.
+func (c *Compiler) CompileBatch(strs []string) ([]*XPath, error) {
+	xs := make([]*XPath, len(strs))
+	for i, str := range strs {
+		x, err := c.Compile(str)
+		if err != nil {
+			return nil, err
+		}
+		xs[i] = x
+	}
+	return xs, nil
+}
+
+// nesting returns the maximum nesting of parentheses and brackets
+// in xpath str, ignoring those in string literals.
+func nesting(str string) int {
+	max, depth := 0, 0
+	var quote byte
+	for i := 0; i < len(str); i++ {
+		switch ch := str[i]; {
+		case quote != 0:
+			if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '(' || ch == '[':
+			depth++
+			if depth > max {
+				max = depth
+			}
+		case ch == ')' || ch == ']':
+			depth--
+		}
+	}
+	return max
+}
+
+// compile compiles e, which is at given depth in the expression tree.
+func (c *Compiler) compile(e xpath.Expr, depth int) Expr {
+	if c.MaxDepth > 0 && depth > c.MaxDepth {
+		panic(TooDeepError(c.MaxDepth))
+	}
 	switch e := e.(type) {
 	case xpath.Number:
 		return numberVal(e)
@@ -45,18 +354,22 @@ func (c *Compiler) compile(e xpath.Expr) Expr {
 	case *xpath.VarRef:
 		return &variable{ClarkName(c.resolvePrefix(e.Prefix), e.Local), Any}
 	case *xpath.NegateExpr:
-		return &negateExpr{asNumber(c.compile(e.Expr))}
+		return &negateExpr{asNumber(c.compile(e.Expr, depth+1))}
 	case *xpath.BinaryExpr:
-		lhs, rhs := c.compile(e.LHS), c.compile(e.RHS)
+		lhs, rhs := c.compile(e.LHS, depth+1), c.compile(e.RHS, depth+1)
 		switch e.Op {
 		case xpath.Add, xpath.Subtract, xpath.Multiply, xpath.Div, xpath.Mod:
-			return &arithmeticExpr{asNumber(lhs), asNumber(rhs), arithmeticOp[e.Op-xpath.Add]}
+			apply := arithmeticOp[e.Op-xpath.Add]
+			if c.StrictNumeric && (e.Op == xpath.Div || e.Op == xpath.Mod) {
+				apply = checkDivisor(e.Op, apply)
+			}
+			return &arithmeticExpr{asNumber(lhs), asNumber(rhs), apply}
 		case xpath.And:
 			return &logicalExpr{asBoolean(lhs), asBoolean(rhs), false}
 		case xpath.Or:
 			return &logicalExpr{asBoolean(lhs), asBoolean(rhs), true}
 		case xpath.EQ, xpath.NEQ:
-			return &equalityExpr{lhs, rhs, equalityOp[e.Op]}
+			return &equalityExpr{lhs, rhs, equalityOp[e.Op], c.Collation}
 		case xpath.LT, xpath.LTE, xpath.GT, xpath.GTE:
 			return &relationalExpr{lhs, rhs, relationalOp[e.Op-xpath.LT]}
 		case xpath.Union:
@@ -69,10 +382,13 @@ func (c *Compiler) compile(e xpath.Expr) Expr {
 		if len(e.Steps) > 0 {
 			steps = make([]*step, len(e.Steps))
 			for i, estep := range e.Steps {
+				if c.AllowedAxes != nil && !c.AllowedAxes[estep.Axis.String()] {
+					panic(DisallowedAxisError(estep.Axis.String()))
+				}
 				s := &step{
 					iter:       iterators[estep.Axis],
 					test:       c.nodeTest(estep.Axis, estep.NodeTest),
-					predicates: c.compilePredicates(estep.Predicates),
+					predicates: c.compilePredicates(estep.Predicates, depth+1),
 				}
 				steps[i] = s
 				switch estep.Axis {
@@ -81,19 +397,30 @@ func (c *Compiler) compile(e xpath.Expr) Expr {
 				}
 			}
 		}
-		return &locationPath{e.Abs, steps}
+		if c.OnWarning != nil {
+			c.checkSteps(e.Steps)
+		}
+		return &locationPath{e.Abs, fuseSteps(e.Steps, steps)}
 	case *xpath.FilterExpr:
-		return &filterExpr{c.compile(e.Expr), c.compilePredicates(e.Predicates)}
+		return &filterExpr{c.compile(e.Expr, depth+1), c.compilePredicates(e.Predicates, depth+1)}
 	case *xpath.PathExpr:
-		return &pathExpr{c.compile(e.Filter), c.compile(e.LocationPath).(*locationPath)}
+		return &pathExpr{c.compile(e.Filter, depth+1), c.compile(e.LocationPath, depth+1).(*locationPath)}
 	case *xpath.FuncCall:
-		fname := ClarkName(c.resolvePrefix(e.Prefix), e.Local)
-		function := coreFunctions[fname]
-		if function == nil && c.Functions != nil {
-			function = c.Functions.Resolve(fname)
-			if function == nil {
+		uri := c.resolvePrefix(e.Prefix)
+		if uri == AxisNS {
+			return c.compileAxis(e, depth)
+		}
+		fname := ClarkName(uri, e.Local)
+		function := c.resolveFunction(fname)
+		if function == nil {
+			if c.DynamicFunctions == nil {
 				panic(UnresolvedFunctionError(fname))
 			}
+			var args []Expr
+			for _, arg := range e.Args {
+				args = append(args, c.compile(arg, depth+1))
+			}
+			return &dynamicFuncCall{fname, args, c.DynamicFunctions, c.StrictFunctions}
 		}
 		if !function.Args.Valid() {
 			panic(SignatureError(fname))
@@ -105,14 +432,18 @@ func (c *Compiler) compile(e xpath.Expr) Expr {
 		if len(e.Args) > 0 {
 			args = make([]Expr, len(e.Args))
 			for i, arg := range e.Args {
-				arg := c.compile(arg)
+				arg := c.compile(arg, depth+1)
 				switch function.Args.typeOf(i) {
 				case Any:
 					args[i] = arg
 				case NodeSet:
 					args[i] = asNodeSet(arg)
 				case String:
-					args[i] = asString(arg)
+					if arg.Returns() == String {
+						args[i] = arg
+					} else {
+						args[i] = c.configure(&stringFunc{arg: arg}, depth+1)
+					}
 				case Number:
 					args[i] = asNumber(arg)
 				case Boolean:
@@ -122,19 +453,64 @@ func (c *Compiler) compile(e xpath.Expr) Expr {
 				}
 			}
 		}
-		return function.Compile(function, args)
+		expr := c.configure(function.Compile(function, args), depth)
+		if c.StrictFunctions && c.Functions != nil && c.Functions.Resolve(fname) == function {
+			expr = &returnCheck{fname, expr.Returns(), expr}
+		}
+		return expr
 	default:
 		panic(fmt.Sprintf("compile(%T) is not implemented", e))
 	}
 }
 
+// compileAxis compiles the call to an axis registered in Axes.
+func (c *Compiler) compileAxis(e *xpath.FuncCall, depth int) Expr {
+	fname := ClarkName(AxisNS, e.Local)
+	iter, ok := c.Axes[e.Local]
+	if !ok {
+		panic(UnresolvedFunctionError(fname))
+	}
+	path := &locationPath{false, []*step{{iter: iter, test: alwaysTrue}}}
+	switch len(e.Args) {
+	case 0:
+		return path
+	case 1:
+		return &pathExpr{asNodeSet(c.compile(e.Args[0], depth+1)), path}
+	default:
+		panic(ArgCountError(fname))
+	}
+}
+
+// configurable is implemented by expressions whose behavior
+// depends on the options of Compiler.
+type configurable interface {
+	// configure applies the compiler options and returns
+	// the expression to be used in place of the receiver.
+	// The depth is that of receiver in the expression tree,
+	// for compiling nested expressions.
+	configure(c *Compiler, depth int) Expr
+}
+
+func (c *Compiler) configure(e Expr, depth int) Expr {
+	if e, ok := e.(configurable); ok {
+		return e.configure(c, depth)
+	}
+	return e
+}
+
 /************************************************************************/
 
+// asNodeSet panics with ConversionError, if e does not return node-set.
+// The variables and dynamic function calls are checked during evaluation.
 func asNodeSet(e Expr) Expr {
-	if v, ok := e.(*variable); ok {
-		v.returns = NodeSet
-	} else if e.Returns() != NodeSet {
-		panic(ConversionError{e.Returns(), NodeSet})
+	switch e := e.(type) {
+	case *variable:
+		e.returns = NodeSet
+	case *dynamicFuncCall:
+	default:
+		if e.Returns() != NodeSet {
+			panic(ConversionError{e.Returns(), NodeSet})
+		}
 	}
 	return e
 }
@@ -143,7 +519,7 @@ func asString(expr Expr) Expr {
 	if expr.Returns() == String {
 		return expr
 	}
-	return &stringFunc{expr}
+	return &stringFunc{arg: expr}
 }
 
 func asNumber(expr Expr) Expr {
@@ -162,16 +538,122 @@ func asBoolean(expr Expr) Expr {
 
 /************************************************************************/
 
+// canonicalizer computes the canonical form of expressions, using
+// the Namespaces and DefaultElementNamespace of Compiler.
+type canonicalizer struct {
+	namespaces       map[string]string
+	defaultNamespace string
+}
+
+// uri returns the namespace uri bound to the prefix. The prefixes
+// are already resolved during compilation.
+func (c canonicalizer) uri(prefix string) string {
+	return c.namespaces[prefix]
+}
+
+// canonical returns the normalized form of parsed expression.
+// Whitespace and redundant parentheses are removed, abbreviated
+// syntax is expanded and the prefixes are replaced with uris.
+func (c canonicalizer) canonical(e xpath.Expr) string {
+	switch e := e.(type) {
+	case xpath.Number, xpath.String:
+		return fmt.Sprint(e)
+	case *xpath.VarRef:
+		return "$" + ClarkName(c.uri(e.Prefix), e.Local)
+	case *xpath.NegateExpr:
+		return "-" + c.canonical(e.Expr)
+	case *xpath.BinaryExpr:
+		return fmt.Sprintf("(%s %s %s)", c.canonical(e.LHS), e.Op, c.canonical(e.RHS))
+	case *xpath.LocationPath:
+		steps := make([]string, len(e.Steps))
+		for i, s := range e.Steps {
+			test := fmt.Sprint(s.NodeTest)
+			if t, ok := s.NodeTest.(*xpath.NameTest); ok {
+				uri := c.uri(t.Prefix)
+				if t.Prefix == "" && t.Local != "*" && s.Axis != xpath.Attribute && s.Axis != xpath.Namespace {
+					uri = c.defaultNamespace
+				}
+				test = ClarkName(uri, t.Local)
+			}
+			steps[i] = fmt.Sprintf("%v::%s%s", s.Axis, test, c.canonicalPredicates(s.Predicates))
+		}
+		if e.Abs {
+			return "/" + strings.Join(steps, "/")
+		}
+		return strings.Join(steps, "/")
+	case *xpath.FilterExpr:
+		return fmt.Sprintf("(%s)%s", c.canonical(e.Expr), c.canonicalPredicates(e.Predicates))
+	case *xpath.PathExpr:
+		return fmt.Sprintf("(%s)/%s", c.canonical(e.Filter), c.canonical(e.LocationPath))
+	case *xpath.FuncCall:
+		args := make([]string, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = c.canonical(arg)
+		}
+		return fmt.Sprintf("%s(%s)", ClarkName(c.uri(e.Prefix), e.Local), strings.Join(args, ", "))
+	}
+	panic(fmt.Sprintf("BUG: unexpected expr %T", e))
+}
+
+func (c canonicalizer) canonicalPredicates(predicates []xpath.Expr) string {
+	var buf bytes.Buffer
+	for _, p := range predicates {
+		fmt.Fprintf(&buf, "[%s]", c.canonical(p))
+	}
+	return buf.String()
+}
+
+// fuseSteps replaces descendant-or-self::node()/child::x, which is
+// the expansion of //x, with the equivalent descendant::x. This avoids
+// collecting all nodes of the subtree only to select their children.
+// The child step must not have predicates, because position() in
+// predicate is relative to the parent.
+func fuseSteps(esteps []*xpath.Step, steps []*step) []*step {
+	var r []*step
+	for i := 0; i < len(steps); i++ {
+		if i+1 < len(steps) && isDescendantOrSelfNode(esteps[i]) &&
+			esteps[i+1].Axis == xpath.Child && len(esteps[i+1].Predicates) == 0 {
+			r = append(r, &step{iter: DescendantAxis, test: steps[i+1].test})
+			i++
+			continue
+		}
+		r = append(r, steps[i])
+	}
+	return r
+}
+
+func isDescendantOrSelfNode(s *xpath.Step) bool {
+	return s.Axis == xpath.DescendantOrSelf && s.NodeTest == xpath.Node && len(s.Predicates) == 0
+}
+
+// checkSteps reports the steps that can never select any node.
+func (c *Compiler) checkSteps(steps []*xpath.Step) {
+	leaf := false // whether previous step selects only nodes without children
+	for _, s := range steps {
+		attrOrNS := s.Axis == xpath.Attribute || s.Axis == xpath.Namespace
+		_, nameTest := s.NodeTest.(*xpath.NameTest)
+		switch {
+		case leaf && (attrOrNS || s.Axis == xpath.Child || s.Axis == xpath.Descendant):
+			c.OnWarning(fmt.Sprintf("step %s never selects nodes, as previous step selects nodes without %s axis", s, s.Axis))
+		case attrOrNS && !nameTest && s.NodeTest != xpath.Node:
+			c.OnWarning(fmt.Sprintf("step %s never selects nodes, as %s axis has no %s nodes", s, s.Axis, s.NodeTest))
+		}
+		// descendant-or-self and self of nodes without children, are themselves
+		selfOnly := leaf && (s.Axis == xpath.Self || s.Axis == xpath.DescendantOrSelf)
+		leaf = selfOnly || attrOrNS || (!nameTest && s.NodeTest != xpath.Node)
+	}
+}
+
 func (c *Compiler) nodeTest(axis xpath.Axis, nodeTest xpath.NodeTest) func(dom.Node) bool {
 	switch test := nodeTest.(type) {
 	case xpath.NodeType:
 		switch test {
 		case xpath.Node:
-			return alwaysTrue
+			return c.stripWhitespace(alwaysTrue)
 		case xpath.Comment:
 			return isComment
 		case xpath.Text:
-			return isText
+			return c.stripWhitespace(isText)
 		}
 	case xpath.PITest:
 		return isProcInst(string(test))
@@ -185,6 +667,9 @@ func (c *Compiler) nodeTest(axis xpath.Axis, nodeTest xpath.NodeTest) func(dom.N
 				}
 				return testAttrNs(uri)
 			}
+			if c.InternNames != nil {
+				return testAttrName(c.InternNames(uri), c.InternNames(test.Local))
+			}
 			return testAttrName(uri, test.Local)
 		case xpath.Namespace:
 			if test.Prefix == "" && test.Local == "*" {
@@ -198,12 +683,78 @@ func (c *Compiler) nodeTest(axis xpath.Axis, nodeTest xpath.NodeTest) func(dom.N
 				}
 				return testElementNS(uri)
 			}
+			if test.Prefix == "" {
+				uri = c.DefaultElementNamespace
+			}
+			if c.InternNames != nil {
+				return testElementName(c.InternNames(uri), c.InternNames(test.Local))
+			}
 			return testElementName(uri, test.Local)
 		}
 	}
 	panic(fmt.Sprintf("BUG: unexpected nodeTest %T", nodeTest))
 }
 
+// stripWhitespace wraps the node test, so that it rejects
+// the whitespace text nodes to be stripped.
+func (c *Compiler) stripWhitespace(test func(dom.Node) bool) func(dom.Node) bool {
+	if !c.StripWhitespace {
+		return test
+	}
+	var names map[dom.Name]struct{}
+	if len(c.StripWhitespaceElements) > 0 {
+		names = make(map[dom.Name]struct{})
+		for _, qname := range c.StripWhitespaceElements {
+			prefix, local := "", qname
+			if colon := strings.IndexByte(qname, ':'); colon != -1 {
+				prefix, local = qname[:colon], qname[colon+1:]
+			}
+			uri := c.resolvePrefix(prefix)
+			if prefix == "" {
+				uri = c.DefaultElementNamespace
+			}
+			names[dom.Name{URI: uri, Local: local}] = struct{}{}
+		}
+	}
+	return func(n dom.Node) bool {
+		if t, ok := n.(*dom.Text); ok && isWhitespace(t.Data) && !preserveSpace(t) {
+			if names == nil {
+				return false
+			}
+			if elem, ok := t.ParentNode.(*dom.Element); ok {
+				if _, ok := names[dom.Name{URI: elem.URI, Local: elem.Local}]; ok {
+					return false
+				}
+			}
+		}
+		return test(n)
+	}
+}
+
+// preserveSpace tells whether the nearest ancestor of n, with
+// xml:space attribute, has value preserve.
+func preserveSpace(n dom.Node) bool {
+	for n = n.Parent(); n != nil; n = n.Parent() {
+		elem, ok := n.(*dom.Element)
+		if !ok {
+			break
+		}
+		if attr := elem.GetAttr("http://www.w3.org/XML/1998/namespace", "space"); attr != nil {
+			return attr.Value == "preserve"
+		}
+	}
+	return false
+}
+
+func isWhitespace(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isSpace(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func alwaysTrue(dom.Node) bool {
 	return true
 }
@@ -289,10 +840,21 @@ func (c *Compiler) resolvePrefix(prefix string) string {
 	panic(UnresolvedPrefixError(prefix))
 }
 
-func (c *Compiler) compilePredicates(predicates []xpath.Expr) predicates {
+// resolveFunction returns the function bound to given clark-name.
+// User defined functions take precedence over built-in functions.
+func (c *Compiler) resolveFunction(fname string) *Function {
+	if c.Functions != nil {
+		if f := c.Functions.Resolve(fname); f != nil {
+			return f
+		}
+	}
+	return coreFunctions[fname]
+}
+
+func (c *Compiler) compilePredicates(predicates []xpath.Expr, depth int) predicates {
 	var arr []Expr
 	for _, p := range predicates {
-		arr = append(arr, c.compile(p))
+		arr = append(arr, c.compile(p, depth))
 	}
 	return arr
 }
@@ -346,6 +908,17 @@ var arithmeticOp = []func(float64, float64) float64{
 	},
 }
 
+// checkDivisor wraps the div or mod operator, so that it
+// panics with DivideByZeroError if the divisor is zero.
+func checkDivisor(op xpath.Op, apply func(float64, float64) float64) func(float64, float64) float64 {
+	return func(x, y float64) float64 {
+		if y == 0 {
+			panic(DivideByZeroError(op.String()))
+		}
+		return apply(x, y)
+	}
+}
+
 var equalityOp = []func(interface{}, interface{}) bool{
 	func(v1, v2 interface{}) bool {
 		return v1 == v2
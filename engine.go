@@ -5,7 +5,11 @@
 package xpath
 
 import (
+	"sync"
+	"time"
+
 	"github.com/santhosh-tekuri/dom"
+	xpath "github.com/santhosh-tekuri/xpathparser"
 )
 
 // XPath is the representation of a compiled xpath 1.0 expression.
@@ -13,6 +17,13 @@ import (
 type XPath struct {
 	str  string
 	expr Expr
+	ast  xpath.Expr
+	opts evalOptions
+	tags *tagCompiler
+
+	canon         canonicalizer
+	canonicalOnce sync.Once
+	canonical     string
 }
 
 // String returns the source xpath expression
@@ -20,6 +31,28 @@ func (x *XPath) String() string {
 	return x.str
 }
 
+// Canonical returns the normalized form of the source xpath expression.
+// Expressions that differ only in whitespace, redundant parentheses,
+// abbreviated syntax or namespace prefixes have same canonical form.
+// So it can be used as key to cache compiled expressions.
+//
+// The canonical form depends only on the expression, and the Namespaces
+// and DefaultElementNamespace of Compiler. The other options of Compiler
+// that change the result, like Collation, BooleanStrings, StripWhitespace,
+// StrictNumeric or Functions, are not part of it. So it is valid as cache
+// key only among the xpaths compiled with same Compiler configuration.
+//
+// Note that the canonical form is not valid xpath, because
+// names are represented as clark-names. It is computed on first
+// call, so the Namespaces of Compiler must not be modified after
+// compiling.
+func (x *XPath) Canonical() string {
+	x.canonicalOnce.Do(func() {
+		x.canonical = x.canon.canonical(x.ast)
+	})
+	return x.canonical
+}
+
 // Returns tells the DataType of value that this expression evaluates to.
 func (x *XPath) Returns() DataType {
 	return x.expr.Returns()
@@ -38,15 +71,160 @@ func (x *XPath) IsStatic() bool {
 //
 // The vars argument can be nil. The DataType of returned value will be *XPath.Returns()
 func (x *XPath) Eval(n dom.Node, vars Variables) (r interface{}, err error) {
+	return x.eval(n, 0, 1, vars, nil)
+}
+
+// EvalIn evaluates the compiled XPath expression in the given context and return the result.
+//
+// Unlike Eval, this lets the caller specify the position and size of the context,
+// for example to evaluate the same expression against each node of a group.
+// Note that Pos and Size only affect position() and last() used outside of
+// predicates, because each predicate is evaluated in its own context.
+//
+// The ctx is not modified or retained, so it can be reused for later evaluations.
+// The DataType of returned value will be *XPath.Returns()
+func (x *XPath) EvalIn(ctx *Context) (r interface{}, err error) {
+	return x.eval(ctx.Node, ctx.Pos, ctx.Size, ctx.Vars, ctx.Root)
+}
+
+func (x *XPath) eval(n dom.Node, pos, size int, vars Variables, root dom.Node) (r interface{}, err error) {
+	state := statePool.Get().(*evalState)
+	state.evalOptions = x.opts
+	ctx := newContext(n, pos, size, vars, root, state)
 	defer func() {
+		releaseContext(ctx)
+		*state = evalState{}
+		statePool.Put(state)
 		panic2error(recover(), &err)
 	}()
-	return x.expr.Eval(&Context{n, 0, 1, vars}), nil
+	r = x.expr.Eval(ctx)
+	state.checkMutation()
+	return r, nil
+}
+
+// BatchEval evaluates the given xpaths in the same context and returns
+// their results. It returns the error of first xpath that fails.
+//
+// The caches built during evaluation, that is string-values of nodes and
+// positions of nodes among their siblings used to sort nodes in document
+// order, are shared by all xpaths. So evaluating many xpaths against a
+// document is cheaper than evaluating them separately. The document must not be
+// modified until BatchEval returns. Functions like date:date-time()
+// return same value across the batch.
+//
+// The vars argument can be nil.
+func BatchEval(n dom.Node, vars Variables, xs []*XPath) (r []interface{}, err error) {
+	state := statePool.Get().(*evalState)
+	ctx := newContext(n, 0, 1, vars, nil, state)
+	defer func() {
+		releaseContext(ctx)
+		*state = evalState{}
+		statePool.Put(state)
+		panic2error(recover(), &err)
+		if err != nil {
+			r = nil
+		}
+	}()
+	r = make([]interface{}, len(xs))
+	for i, x := range xs {
+		state.visited, state.evalOptions = 0, x.opts
+		r[i] = x.expr.Eval(ctx)
+		state.checkMutation()
+	}
+	return r, nil
+}
+
+// EvalForEach evaluates the compiled XPath expression with each of the given
+// nodes as context node, and calls fn with the node and the result. The
+// position() and last() used outside of predicates, give the position of
+// node in nodes and the number of nodes. Iteration stops when fn returns
+// error, and that error is returned.
+//
+// Like BatchEval, the caches built during evaluation are shared by all
+// evaluations. So the document must not be modified until EvalForEach
+// returns, not even by fn.
+//
+// The vars argument can be nil.
+func (x *XPath) EvalForEach(nodes []dom.Node, vars Variables, fn func(dom.Node, interface{}) error) error {
+	state := statePool.Get().(*evalState)
+	state.evalOptions = x.opts
+	ctx := newContext(nil, 0, len(nodes), vars, nil, state)
+	defer func() {
+		releaseContext(ctx)
+		*state = evalState{}
+		statePool.Put(state)
+	}()
+	for i, n := range nodes {
+		ctx.Node, ctx.Pos = n, i+1
+		state.visited = 0
+		r, err := x.evalWith(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(n, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evalWith evaluates the expression in ctx, which
+// is already initialized for evaluation.
+func (x *XPath) evalWith(ctx *Context) (r interface{}, err error) {
+	defer func() {
+		panic2error(recover(), &err)
+	}()
+	r = x.expr.Eval(ctx)
+	ctx.state.checkMutation()
+	return r, nil
+}
+
+// XPathSet is a set of compiled xpaths, which are evaluated as boolean
+// against a node, for example the rules to be satisfied by the node.
+type XPathSet []*XPath
+
+// AnyMatch tells whether any of the xpaths evaluates to true. The xpaths
+// are evaluated in order, and the evaluation stops at first xpath that
+// evaluates to true. It returns false, if the set is empty.
+//
+// The vars argument can be nil.
+func (xs XPathSet) AnyMatch(n dom.Node, vars Variables) (bool, error) {
+	for _, x := range xs {
+		b, err := x.EvalBoolean(n, vars)
+		if err != nil {
+			return false, err
+		}
+		if b {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AllMatch tells whether all of the xpaths evaluate to true. The xpaths
+// are evaluated in order, and the evaluation stops at first xpath that
+// evaluates to false. It returns true, if the set is empty.
+//
+// The vars argument can be nil.
+func (xs XPathSet) AllMatch(n dom.Node, vars Variables) (bool, error) {
+	for _, x := range xs {
+		b, err := x.EvalBoolean(n, vars)
+		if err != nil {
+			return false, err
+		}
+		if !b {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
 // EvalNodeSet evaluates the compiled XPath expression in given context and returns []dom.Node value.
 // if the result cannot be converted to []dom.Node, returns ConversionError
 //
+// If the type of expression cannot be statically determined, for example
+// a variable reference, the conversion is attempted on the evaluated value.
+//
 // The vars argument can be nil.
 func (x *XPath) EvalNodeSet(n dom.Node, vars Variables) ([]dom.Node, error) {
 	switch x.Returns() {
@@ -64,6 +242,51 @@ func (x *XPath) EvalNodeSet(n dom.Node, vars Variables) ([]dom.Node, error) {
 	}
 }
 
+// EvalEach evaluates the compiled XPath expression in given context and calls fn
+// for each node in the resulting node-set, in document order. Iteration stops when
+// fn returns false. if the result cannot be converted to []dom.Node, returns ConversionError
+//
+// Note that node-sets bound to variables are visited in the order they are given.
+// The fn must not modify the document.
+//
+// The vars argument can be nil.
+func (x *XPath) EvalEach(n dom.Node, vars Variables, fn func(dom.Node) bool) error {
+	ns, err := x.EvalNodeSet(n, vars)
+	if err != nil {
+		return err
+	}
+	for _, n := range ns {
+		if !fn(n) {
+			break
+		}
+	}
+	return nil
+}
+
+// EvalStrings evaluates the compiled XPath expression in given context and returns
+// the string-value of each node in the resulting node-set, in document order.
+// If the result is not a node-set, it returns the result converted to string,
+// as the only element.
+//
+// Note that node-sets bound to variables are returned in the order they are given.
+//
+// The vars argument can be nil.
+func (x *XPath) EvalStrings(n dom.Node, vars Variables) ([]string, error) {
+	r, err := x.Eval(n, vars)
+	if err != nil {
+		return nil, err
+	}
+	ns, ok := r.([]dom.Node)
+	if !ok {
+		return []string{x.opts.value2String(r)}, nil
+	}
+	strs := make([]string, len(ns))
+	for i, n := range ns {
+		strs[i] = Node2String(n)
+	}
+	return strs, nil
+}
+
 // EvalString evaluates the compiled XPath expression in given context and returns string value.
 //
 // The vars argument can be nil.
@@ -72,7 +295,7 @@ func (x *XPath) EvalString(n dom.Node, vars Variables) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return Value2String(r), nil
+	return x.opts.value2String(r), nil
 }
 
 // EvalNumber evaluates the compiled XPath expression in given context and returns float64 value.
@@ -97,7 +320,100 @@ func (x *XPath) EvalBoolean(n dom.Node, vars Variables) (bool, error) {
 	return Value2Boolean(r), nil
 }
 
+// EvalBooleanStrict evaluates the compiled XPath expression in given context
+// and tells whether the resulting node-set is non-empty.
+//
+// Unlike EvalBoolean, it expects the expression to return node-set, so that
+// a missing node is not confused with a node whose value is false. For
+// example string(@x) is false for both missing and empty attribute, but
+// @x is true when the attribute exists. If the result is not a
+// node-set, it returns the result converted to bool, along with
+// ConversionError. So the caller can still use the value, if it wants to.
+//
+// The vars argument can be nil.
+func (x *XPath) EvalBooleanStrict(n dom.Node, vars Variables) (bool, error) {
+	r, err := x.Eval(n, vars)
+	if err != nil {
+		return false, err
+	}
+	if ns, ok := r.([]dom.Node); ok {
+		return len(ns) > 0, nil
+	}
+	return Value2Boolean(r), ConversionError{TypeOf(r), NodeSet}
+}
+
+// Matches evaluates the compiled XPath expression in given context
+// and returns the result converted to bool.
+//
+// Unlike EvalBoolean, for location paths and their unions it stops
+// as soon as a node is found, rather than computing whole node-set.
+//
+// The vars argument can be nil.
+func (x *XPath) Matches(n dom.Node, vars Variables) (bool, error) {
+	r, err := (&XPath{str: x.str, expr: asBoolean(x.expr), opts: x.opts}).Eval(n, vars)
+	if err != nil {
+		return false, err
+	}
+	return r.(bool), nil
+}
+
+// EvalResult evaluates the compiled XPath expression in given context and returns the result
+// wrapped in Result, which converts it to the type required.
+//
+// The vars argument can be nil.
+func (x *XPath) EvalResult(n dom.Node, vars Variables) (Result, error) {
+	r, err := x.Eval(n, vars)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{r}, nil
+}
+
+// Result represents the value of evaluated xpath expression.
+// The conversions are applied only when requested.
+type Result struct {
+	value interface{}
+}
+
+// Value returns the underlying value, which will be
+// []dom.Node, string, float64 or bool.
+func (r Result) Value() interface{} {
+	return r.value
+}
+
+// Type returns the DataType of the underlying value.
+func (r Result) Type() DataType {
+	return TypeOf(r.value)
+}
+
+// NodeSet returns the value as []dom.Node. if the value
+// is not node-set, it returns ConversionError.
+func (r Result) NodeSet() ([]dom.Node, error) {
+	if ns, ok := r.value.([]dom.Node); ok {
+		return ns, nil
+	}
+	return nil, ConversionError{r.Type(), NodeSet}
+}
+
+// String returns the value converted to string.
+func (r Result) String() string {
+	return Value2String(r.value)
+}
+
+// Number returns the value converted to float64.
+func (r Result) Number() float64 {
+	return Value2Number(r.value)
+}
+
+// Boolean returns the value converted to bool.
+func (r Result) Boolean() bool {
+	return Value2Boolean(r.value)
+}
+
 // Context represents the evaluation context of xpath engine.
+//
+// The contexts passed to Expr.Eval are reused once the
+// evaluation is done, so they must not be retained.
 type Context struct {
 	// Node is the current node in context-set
 	Node dom.Node
@@ -105,22 +421,269 @@ type Context struct {
 	// Pos is the position of current node in context-set
 	Pos int
 
-	// Size is the size of the context-set
+	// Size is the size of the context-set.
+	//
+	// It is returned by last() used outside of predicates. Eval always
+	// uses 1, use EvalIn to evaluate with different size. Inside a
+	// predicate, last() returns the size of node-set being filtered.
 	Size int
 
 	// Vars is the set of variable bindings
 	Vars Variables
+
+	// Root, if not nil, is used as the root node by absolute
+	// location paths instead of the document node. This allows
+	// querying a fragment in isolation. Note that the axes such
+	// as ancestor and preceding are not limited to Root.
+	Root dom.Node
+
+	state *evalState
+
+	// outer is the context, in which the predicate being
+	// evaluated in this context appears. It is nil outside
+	// of predicates.
+	outer *Context
+}
+
+// Contexts and their evalState are pooled to avoid allocation
+// per evaluation. They are reset before returning to the pool.
+var (
+	contextPool = sync.Pool{New: func() interface{} { return new(Context) }}
+	statePool   = sync.Pool{New: func() interface{} { return new(evalState) }}
+)
+
+func newContext(n dom.Node, pos, size int, vars Variables, root dom.Node, state *evalState) *Context {
+	ctx := contextPool.Get().(*Context)
+	*ctx = Context{n, pos, size, vars, root, state, nil}
+	return ctx
+}
+
+// push returns new context for evaluating a predicate on node-set
+// of given size, with ctx as its outer context. The new context
+// must be released using releaseContext.
+func (ctx *Context) push(n dom.Node, pos, size int) *Context {
+	inner := newContext(n, pos, size, ctx.Vars, ctx.Root, ctx.state)
+	inner.outer = ctx
+	return inner
+}
+
+func releaseContext(ctx *Context) {
+	*ctx = Context{}
+	contextPool.Put(ctx)
+}
+
+// evalState holds the state shared by all contexts of a single evaluation.
+//
+// The caches assume that the document is not modified during evaluation.
+type evalState struct {
+	// strings caches string-value of element and document nodes.
+	strings map[dom.Node]string
+
+	// numbers caches string-value converted to float64.
+	numbers map[dom.Node]float64
+
+	// index caches position of child nodes among their siblings,
+	// used to sort nodes in document order.
+	index map[dom.Node]int
+
+	// now is the current time, computed on first use.
+	now time.Time
+
+	// vars caches values of LazyVariables.
+	vars map[string]interface{}
+
+	// visited is the number of nodes visited by location steps.
+	// It is tracked only if maxNodes is positive.
+	visited int
+
+	// shapes records the shape of nodes visited by location steps.
+	// It is tracked only if detectMutation is true.
+	shapes map[dom.Node]shape
+
+	// sequence is the document of text nodes returned by functions
+	// returning sequence, created on first use. It grows as such
+	// functions are called, so its string-value is not cached.
+	sequence *dom.Document
+
+	evalOptions
+}
+
+// evalOptions are the Compiler options, that are used during evaluation.
+type evalOptions struct {
+	// maxNodes is the Compiler.MaxNodesVisited.
+	maxNodes int
+
+	// attrDocOrder tells whether attributes of an element are
+	// in declaration order, as per Compiler.AttributeOrder.
+	attrDocOrder bool
+
+	// detectMutation is the Compiler.DetectMutation.
+	detectMutation bool
+
+	// booleanStrings is the Compiler.BooleanStrings.
+	booleanStrings [2]string
 }
 
-// Document returns the Document of current node in context-set
+// value2String is same as Value2String, but converts
+// booleans as per Compiler.BooleanStrings.
+func (o *evalOptions) value2String(v interface{}) string {
+	if b, ok := v.(bool); ok && o.booleanStrings != [2]string{} {
+		if b {
+			return o.booleanStrings[1]
+		}
+		return o.booleanStrings[0]
+	}
+	return Value2String(v)
+}
+
+// Document returns the Document of current node in context-set.
+// It returns nil, if the node is not part of any document.
 func (ctx *Context) Document() *dom.Document {
-	n := ctx.Node
-	for {
-		if d, ok := n.(*dom.Document); ok {
-			return d
+	d, _ := root(ctx.Node).(*dom.Document)
+	return d
+}
+
+// visit counts a node visited by location step. It panics
+// with BudgetExceededError, if the budget is exceeded.
+func (ctx *Context) visit(n dom.Node) {
+	if s := ctx.state; s != nil && s.maxNodes > 0 {
+		s.visited++
+		if s.visited > s.maxNodes {
+			panic(BudgetExceededError(s.maxNodes))
+		}
+	}
+	ctx.record(n)
+}
+
+// shape is the number of children and attributes of a node.
+type shape struct {
+	children, attrs int
+}
+
+func shapeOf(n dom.Node) shape {
+	switch n := n.(type) {
+	case *dom.Element:
+		return shape{len(n.Children()), len(n.Attrs)}
+	case *dom.Document:
+		return shape{len(n.Children()), 0}
+	}
+	return shape{}
+}
+
+// record remembers the shape of node n, if not already recorded.
+// It does nothing, unless compiled with Compiler.DetectMutation.
+func (ctx *Context) record(n dom.Node) {
+	s := ctx.state
+	if s == nil || !s.detectMutation {
+		return
+	}
+	if s.shapes == nil {
+		s.shapes = make(map[dom.Node]shape)
+	}
+	if _, ok := s.shapes[n]; !ok {
+		s.shapes[n] = shapeOf(n)
+	}
+}
+
+// checkMutation panics with ConcurrentModificationError, if the shape
+// of any recorded node has changed.
+func (s *evalState) checkMutation() {
+	for n, sh := range s.shapes {
+		if n == dom.Node(s.sequence) {
+			continue
+		}
+		if shapeOf(n) != sh {
+			panic(ConcurrentModificationError{n, NodePath(n)})
+		}
+	}
+}
+
+// node2String returns the string-value of the node.
+// If available, it uses the string-value cache of current evaluation.
+func (ctx *Context) node2String(n dom.Node) string {
+	switch n.(type) {
+	case *dom.Element, *dom.Document:
+		if ctx == nil || ctx.state == nil || n == dom.Node(ctx.state.sequence) {
+			break
 		}
-		n = Parent(n)
+		if s, ok := ctx.state.strings[n]; ok {
+			return s
+		}
+		if ctx.state.strings == nil {
+			ctx.state.strings = make(map[dom.Node]string)
+		}
+		s := Node2String(n)
+		ctx.state.strings[n] = s
+		return s
+	}
+	return Node2String(n)
+}
+
+// node2Number returns the string-value of the node converted to float64.
+// If available, it uses the number cache of current evaluation.
+func (ctx *Context) node2Number(n dom.Node) float64 {
+	if ctx == nil || ctx.state == nil || n == dom.Node(ctx.state.sequence) {
+		return Node2Number(n)
+	}
+	if f, ok := ctx.state.numbers[n]; ok {
+		return f
+	}
+	if ctx.state.numbers == nil {
+		ctx.state.numbers = make(map[dom.Node]float64)
+	}
+	f := String2Number(ctx.node2String(n))
+	ctx.state.numbers[n] = f
+	return f
+}
+
+// value2String is same as Value2String, but uses the
+// string-value cache of current evaluation.
+func (ctx *Context) value2String(v interface{}) string {
+	if ns, ok := v.([]dom.Node); ok && len(ns) > 0 {
+		return ctx.node2String(ns[0])
+	}
+	if ctx != nil && ctx.state != nil {
+		return ctx.state.value2String(v)
+	}
+	return Value2String(v)
+}
+
+// value2Number is same as Value2Number, but uses the
+// string-value cache of current evaluation.
+func (ctx *Context) value2Number(v interface{}) float64 {
+	if ns, ok := v.([]dom.Node); ok && len(ns) > 0 {
+		return ctx.node2Number(ns[0])
 	}
+	return Value2Number(v)
+}
+
+// now returns the current time.
+// It returns same value for all calls during an evaluation.
+func (ctx *Context) now() time.Time {
+	if ctx == nil || ctx.state == nil {
+		return time.Now()
+	}
+	if ctx.state.now.IsZero() {
+		ctx.state.now = time.Now()
+	}
+	return ctx.state.now
+}
+
+// lazyVar returns the value of variable computed by f.
+// f is called only on first reference during an evaluation.
+func (ctx *Context) lazyVar(f LazyVariables, variable string) interface{} {
+	if ctx.state == nil {
+		return f(variable)
+	}
+	if v, ok := ctx.state.vars[variable]; ok {
+		return v
+	}
+	if ctx.state.vars == nil {
+		ctx.state.vars = make(map[string]interface{})
+	}
+	v := f(variable)
+	ctx.state.vars[variable] = v
+	return v
 }
 
 // Variables is interface that is used to evaluate variable references.
@@ -134,6 +697,22 @@ type Variables interface {
 	Eval(variable string) interface{}
 }
 
+// VariablesErr is an optional interface implemented by Variables,
+// that wants to report errors during variable evaluation.
+//
+// If the Variables also implements VariablesErr, EvalVar is used
+// instead of Eval, and the error returned is reported by *XPath.Eval.
+// This allows to distinguish missing variables, type errors and
+// lazy-loading failures.
+type VariablesErr interface {
+	// EvalVar returns the value of the variable. The argument is the
+	// clark-name of the variable. If there is no such variable, it should
+	// return UnresolvedVariableError.
+	//
+	// The returned value must be []dom.Node, string, float64 or bool.
+	EvalVar(variable string) (interface{}, error)
+}
+
 // VariableMap implements Variables interface using map.
 //
 // Key must be clark-name of variable.
@@ -146,10 +725,33 @@ func (vm VariableMap) Eval(variable string) interface{} {
 	return vm[variable]
 }
 
+// LazyVariables implements Variables interface using function,
+// which computes the value of variable when it is referenced.
+// Use it when variables are expensive to compute and not all
+// of them are referenced by the xpath.
+//
+// The value is remembered for the rest of evaluation, so the function
+// is called at most once per variable in a single evaluation, no matter
+// how many times the variable is referenced. It is called again in next
+// evaluation.
+//
+// The argument is clark-name of variable. The function should return
+// nil, if there is no such variable.
+type LazyVariables func(variable string) interface{}
+
+// Eval returns the value of the variable by calling f.
+//
+// Note that Eval is not memoized. The memoization is done
+// only when variable is referenced by xpath evaluation.
+func (f LazyVariables) Eval(variable string) interface{} {
+	return f(variable)
+}
+
 // Functions is interface that provides access to the set of
 // user defined functions during xpath expression compilation.
 //
-// This cannot be used to override XPath built-in functions.
+// A function resolved by this interface overrides the XPath
+// built-in function with same name.
 // In the course of evaluating any single XPath expression, a function must not change.
 type Functions interface {
 	// Resolve find a function bound to the given name in the set of available functions.
@@ -168,3 +770,19 @@ type FunctionMap map[string]*Function
 func (fm FunctionMap) Resolve(function string) *Function {
 	return fm[function]
 }
+
+// FunctionLibrary implements Functions interface by composing
+// multiple Functions. The functions are resolved by consulting
+// each Functions in order, so the earlier ones take precedence.
+type FunctionLibrary []Functions
+
+// Resolve returns the first *Function bound to given function name.
+// It returns nil if no function is bound.
+func (fl FunctionLibrary) Resolve(function string) *Function {
+	for _, functions := range fl {
+		if f := functions.Resolve(function); f != nil {
+			return f
+		}
+	}
+	return nil
+}
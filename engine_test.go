@@ -5,15 +5,22 @@
 package xpath
 
 import (
+	"bytes"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/santhosh-tekuri/dom"
+	"github.com/santhosh-tekuri/xpathparser"
 )
 
 func TestSimplify(t *testing.T) {
@@ -29,6 +36,9 @@ func TestSimplify(t *testing.T) {
 		`'' and //employee/name`:        false,
 		`//employee/name or 'santhosh'`: true,
 		`//employee/name and ''`:        false,
+		`string(true())`:                "true",
+		`concat('a', true())`:           "atrue",
+		`string-length(false())`:        float64(5),
 	}
 	compiler := new(Compiler)
 	for xpath, expected := range tests {
@@ -53,6 +63,34 @@ func TestSimplify(t *testing.T) {
 	}
 }
 
+// sameAsUnsimplified tells whether compiling xpath with NoSimplify
+// gives the same result.
+func sameAsUnsimplified(t *testing.T, compiler *Compiler, xpath string, context dom.Node, vars Variables, expected interface{}) bool {
+	t.Helper()
+	c := *compiler
+	c.NoSimplify = true
+	x, err := c.Compile(xpath)
+	if err != nil {
+		t.Error("FAIL: NoSimplify:", err)
+		return false
+	}
+	got, err := x.Eval(context, vars)
+	if err != nil {
+		t.Error("FAIL: NoSimplify:", err)
+		return false
+	}
+	if f, ok := expected.(float64); ok && math.IsNaN(f) {
+		if g, ok := got.(float64); ok && math.IsNaN(g) {
+			return true
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("FAIL: NoSimplify: expected %#v, but got %#v", expected, got)
+		return false
+	}
+	return true
+}
+
 func TestEval(t *testing.T) {
 	functions := FunctionMap{
 		"repeat": &Function{String, Args{Mandatory(String), Mandatory(Number)}, CompileFunc(repeat)},
@@ -155,6 +193,9 @@ func TestEval(t *testing.T) {
 					t.Error("FAIL:", err)
 					continue
 				}
+				if !sameAsUnsimplified(t, compiler, xpathStr, context, vars, got) {
+					continue
+				}
 				switch expected := expected.(type) {
 				case float64:
 					_, ok := got.(float64)
@@ -219,81 +260,9 @@ func TestEval(t *testing.T) {
 }
 
 func getXPath(n dom.Node, uri2prefix map[string]string) string {
-	if _, ok := n.(*dom.Document); ok {
-		return "/"
-	}
-
-	var arr []string
-	for {
-		switch x := n.(type) {
-		case *dom.Document:
-			// do nothing
-		case *dom.Element:
-			pos := 0
-			for _, c := range x.Parent().Children() {
-				if c, ok := c.(*dom.Element); ok {
-					if c.URI == x.URI && c.Local == x.Local {
-						pos++
-					}
-					if c == x {
-						break
-					}
-				}
-			}
-			arr = append(arr, fmt.Sprintf("%s[%d]", getQName(x.Name, uri2prefix), pos))
-		case *dom.Attr:
-			arr = append(arr, "@"+getQName(x.Name, uri2prefix))
-		case *dom.Text:
-			pos := 0
-			for _, c := range x.Parent().Children() {
-				if c, ok := c.(*dom.Text); ok {
-					pos++
-					if c == x {
-						break
-					}
-				}
-			}
-			arr = append(arr, fmt.Sprintf("text()[%d]", pos))
-		case *dom.Comment:
-			pos := 0
-			for _, c := range x.Parent().Children() {
-				if c, ok := c.(*dom.Comment); ok {
-					pos++
-					if c == x {
-						break
-					}
-				}
-			}
-			arr = append(arr, fmt.Sprintf("comment()[%d]", pos))
-		case *dom.ProcInst:
-			pos := 0
-			for _, c := range x.Parent().Children() {
-				if c, ok := c.(*dom.ProcInst); ok {
-					if c.Target == x.Target {
-						pos++
-					}
-					if c == x {
-						break
-					}
-				}
-			}
-			arr = append(arr, fmt.Sprintf("processing-instruction(%q)[%d]", x.Target, pos))
-		case *dom.NameSpace:
-			arr = append(arr, fmt.Sprintf("namespace::%s", x.Prefix))
-		default:
-			panic(fmt.Sprintf("getXPath(%T) is not implemented", x))
-		}
-		n = Parent(n)
-		if n == nil {
-			break
-		}
-	}
-
-	xpath := ""
-	for i := len(arr) - 1; i >= 0; i-- {
-		xpath += "/" + arr[i]
-	}
-	return xpath
+	return nodePath(n, func(name *dom.Name) string {
+		return getQName(name, uri2prefix)
+	})
 }
 
 func getQName(name *dom.Name, uri2prefix map[string]string) string {
@@ -313,3 +282,2909 @@ func getQName(name *dom.Name, uri2prefix map[string]string) string {
 func repeat(args []interface{}) interface{} {
 	return strings.Repeat(args[0].(string), int(args[1].(float64)))
 }
+
+func TestCollation(t *testing.T) {
+	doc := parseXML(t, `<root><name>Santhosh</name><name>KUMAR</name></root>`)
+	tests := []struct {
+		xpath            string
+		exact, collation bool
+	}{
+		{`starts-with('Santhosh', 'san')`, false, true},
+		{`ends-with('Santhosh', 'SH')`, false, true},
+		{`contains('Santhosh', 'THO')`, false, true},
+		{`'Santhosh' = 'santhosh'`, false, true},
+		{`'Santhosh' != 'santhosh'`, true, false},
+		{`/root/name = 'kumar'`, false, true},
+		{`/root/name[1] = /root/name[. = 'santhosh']`, false, true},
+		{`contains('Santhosh', 'x')`, false, false},
+		{`ext:compare('Santhosh', 'santhosh') = 0`, false, true},
+		{`ext:compare('santhosh', 'KUMAR') = 1`, true, true},
+	}
+	ns := map[string]string{"ext": ExtensionNS}
+	for _, test := range tests {
+		for _, c := range []*Compiler{{Namespaces: ns}, {Namespaces: ns, Collation: CaseInsensitive}} {
+			expected := test.exact
+			if c.Collation != nil {
+				expected = test.collation
+			}
+			expr, err := c.Compile(test.xpath)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", test.xpath, err)
+				continue
+			}
+			actual, err := expr.EvalBoolean(doc, nil)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", test.xpath, err)
+				continue
+			}
+			if actual != expected {
+				t.Errorf("FAIL: xpath: %v collation: %v expected: %v actual: %v", test.xpath, c.Collation != nil, expected, actual)
+			}
+		}
+	}
+}
+
+func parseXML(t testing.TB, str string) *dom.Document {
+	t.Helper()
+	doc, err := dom.Unmarshal(xml.NewDecoder(strings.NewReader(str)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestOverrideCoreFunction(t *testing.T) {
+	concat := func(args []interface{}) interface{} {
+		var a []string
+		for _, arg := range args {
+			a = append(a, arg.(string))
+		}
+		return strings.Join(a, "-")
+	}
+	compiler := &Compiler{
+		Functions: FunctionMap{
+			"concat": &Function{String, Args{Variadic(String)}, CompileFunc(concat)},
+		},
+	}
+	expr, err := compiler.Compile(`concat('a', 'b', 'c')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := expr.EvalString(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "a-b-c" {
+		t.Errorf("expected %q, but got %q", "a-b-c", s)
+	}
+
+	expr, err = compiler.Compile(`substring('abc', 2)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = expr.EvalString(nil, nil); err != nil {
+		t.Fatal(err)
+	} else if s != "bc" {
+		t.Errorf("expected %q, but got %q", "bc", s)
+	}
+}
+
+func TestDynamicFunctions(t *testing.T) {
+	functions := FunctionMap{}
+	compiler := &Compiler{
+		Namespaces:       map[string]string{"x": "www.example.com"},
+		DynamicFunctions: functions,
+	}
+	expr, err := compiler.Compile(`x:repeat('ab', 1+2)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Returns() != Any {
+		t.Errorf("expected %v, but got %v", Any, expr.Returns())
+	}
+	if arg := expr.expr.(*dynamicFuncCall).args[1]; arg != numberVal(3) {
+		t.Errorf("argument must be simplified, but got %#v", arg)
+	}
+	if _, err := expr.EvalString(nil, nil); err != UnresolvedFunctionError("{www.example.com}repeat") {
+		t.Errorf("expected UnresolvedFunctionError, but got %v", err)
+	}
+
+	functions["{www.example.com}repeat"] = &Function{String, Args{Mandatory(String), Mandatory(Number)}, CompileFunc(repeat)}
+	s, err := expr.EvalString(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "ababab" {
+		t.Errorf("expected %q, but got %q", "ababab", s)
+	}
+
+	functions["{www.example.com}repeat"] = &Function{String, Args{Mandatory(String), Mandatory(Number)}, CompileFunc(func(args []interface{}) interface{} {
+		return 1
+	})}
+	if _, err := expr.Eval(nil, nil); err != (InvalidValueError{1}) {
+		t.Errorf("expected InvalidValueError, but got %v", err)
+	}
+
+	if _, err := new(Compiler).Compile(`repeat('ab', 3)`); err != UnresolvedFunctionError("repeat") {
+		t.Errorf("expected UnresolvedFunctionError, but got %v", err)
+	}
+}
+
+type errVariables map[string]interface{}
+
+func (vm errVariables) Eval(variable string) interface{} {
+	return vm[variable]
+}
+
+func (vm errVariables) EvalVar(variable string) (interface{}, error) {
+	if variable == "broken" {
+		return nil, errors.New("failed to load broken")
+	}
+	if v, ok := vm[variable]; ok {
+		return v, nil
+	}
+	return nil, UnresolvedVariableError(variable)
+}
+
+func TestVariablesErr(t *testing.T) {
+	vars := errVariables{"v": float64(2)}
+	tests := map[string]error{
+		`$v * 2`:       nil,
+		`$broken`:      errors.New("failed to load broken"),
+		`$missing + 1`: UnresolvedVariableError("missing"),
+	}
+	for xpath, expected := range tests {
+		expr, err := new(Compiler).Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		_, err = expr.Eval(nil, vars)
+		if fmt.Sprint(err) != fmt.Sprint(expected) {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", xpath, expected, err)
+		}
+	}
+}
+
+func TestDefaultElementNamespace(t *testing.T) {
+	doc := parseXML(t, `<a xmlns="www.example.com" x="1"><b x="2"/><b/><c xmlns=""/></a>`)
+	tests := []struct {
+		xpath    string
+		strict   float64
+		defaultN float64
+	}{
+		{`count(/a/b)`, 0, 2},
+		{`count(//b[@x])`, 0, 1},
+		{`count(/*/*)`, 3, 3},
+		{`count(//c)`, 1, 0},
+		{`count(/a/self::a)`, 0, 1},
+	}
+	for _, test := range tests {
+		for _, c := range []*Compiler{{}, {DefaultElementNamespace: "www.example.com"}} {
+			expected := test.strict
+			if c.DefaultElementNamespace != "" {
+				expected = test.defaultN
+			}
+			expr, err := c.Compile(test.xpath)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", test.xpath, err)
+				continue
+			}
+			actual, err := expr.EvalNumber(doc, nil)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", test.xpath, err)
+				continue
+			}
+			if actual != expected {
+				t.Errorf("FAIL: xpath: %v defaultNamespace: %q expected: %v actual: %v", test.xpath, c.DefaultElementNamespace, expected, actual)
+			}
+		}
+	}
+}
+
+func TestNodeSetConversion(t *testing.T) {
+	str := func(args []interface{}) interface{} {
+		return "santhosh"
+	}
+	nodes := func(args []interface{}) interface{} {
+		return []dom.Node{new(dom.Text), new(dom.Text)}
+	}
+	compiler := &Compiler{
+		Functions: FunctionMap{
+			"any": &Function{Any, nil, CompileFunc(nodes)},
+		},
+		DynamicFunctions: FunctionMap{
+			"str":   &Function{String, nil, CompileFunc(str)},
+			"nodes": &Function{NodeSet, nil, CompileFunc(nodes)},
+		},
+	}
+	vars := VariableMap{"v": "santhosh"}
+	tests := map[string]error{
+		`count($v)`:    VarMustBeNodeSet("v"),
+		`sum($v)`:      VarMustBeNodeSet("v"),
+		`$v/name`:      ConversionError{String, NodeSet},
+		`$v[1]`:        ConversionError{String, NodeSet},
+		`count(str())`: ConversionError{String, NodeSet},
+		`name(str())`:  ConversionError{String, NodeSet},
+		`str() | $v`:   ConversionError{String, NodeSet},
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if _, err = expr.Eval(nil, vars); err != expected {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", xpath, expected, err)
+		}
+	}
+
+	expr, err := compiler.Compile(`count(nodes())`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := expr.EvalNumber(nil, nil); err != nil || n != 2 {
+		t.Errorf("FAIL: count(nodes()): expected 2, but got %v, %v", n, err)
+	}
+	for _, xpath := range []string{`count(any())`, `sum(any())`, `any() | $v`} {
+		if _, err := compiler.Compile(xpath); err != (ConversionError{Any, NodeSet}) {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", xpath, ConversionError{Any, NodeSet}, err)
+		}
+	}
+}
+
+func BenchmarkSelfJoin(b *testing.B) {
+	text := strings.Repeat("lorem ipsum dolor sit amet ", 20)
+	buf := new(bytes.Buffer)
+	buf.WriteString("<root>")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(buf, "<item><p>item %d</p><p>%s</p></item>", i, text)
+	}
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(buf, "<ref><p>item %d</p><p>%s</p></ref>", i*10, text)
+	}
+	buf.WriteString("</root>")
+	doc := parseXML(b, buf.String())
+	expr, err := new(Compiler).Compile(`//item[. = //ref]`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ns, err := expr.EvalNodeSet(doc, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(ns) != 20 {
+			b.Fatalf("expected 20 nodes, but got %d", len(ns))
+		}
+	}
+}
+
+func TestInvalidCodepoint(t *testing.T) {
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	tests := map[string]error{
+		`ext:codepoints-to-string(ext:string-to-codepoints('1.5'))`: nil,
+		`ext:codepoints-to-string($v)`:                              InvalidCodepointError(1.5),
+		`ext:codepoints-to-string($v[2])`:                           InvalidCodepointError(55296),
+		`ext:codepoints-to-string($v[3])`:                           InvalidCodepointError(-1),
+	}
+	vars := VariableMap{
+		"v": parseXML(t, `<v><a>1.5</a><a>55296</a><a>-1</a></v>`).Children()[0].(*dom.Element).Children(),
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if _, err = expr.Eval(nil, vars); err != expected {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", xpath, expected, err)
+		}
+	}
+}
+
+func TestDateTime(t *testing.T) {
+	compiler := &Compiler{Namespaces: map[string]string{"date": EXSLTDates}}
+	expr, err := compiler.Compile(`date:date-time()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := expr.EvalString(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(now); d < 0 || d > time.Minute {
+		t.Errorf("date:date-time() returned %s", s)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	eval := func(c *Compiler) []float64 {
+		t.Helper()
+		c.Namespaces = map[string]string{"math": EXSLTMath}
+		expr, err := c.Compile(`math:random()`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expr.IsStatic() {
+			t.Fatal("math:random() must not be static")
+		}
+		var r []float64
+		for i := 0; i < 5; i++ {
+			f, err := expr.EvalNumber(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f < 0 || f >= 1 {
+				t.Fatalf("math:random() returned %v", f)
+			}
+			r = append(r, f)
+		}
+		return r
+	}
+	r1 := eval(&Compiler{RandSource: rand.NewSource(1)})
+	r2 := eval(&Compiler{RandSource: rand.NewSource(1)})
+	if fmt.Sprint(r1) != fmt.Sprint(r2) {
+		t.Errorf("same seed must give same numbers: %v %v", r1, r2)
+	}
+	if r := eval(new(Compiler)); r[0] == r[1] {
+		t.Errorf("math:random() must not be folded: %v", r)
+	}
+}
+
+func TestFunctionAvailable(t *testing.T) {
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	expr, err := compiler.Compile(`ext:function-available('ext:compare')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expr.IsStatic() {
+		t.Error("function-available must be folded at compile time")
+	}
+	tests := map[string]error{
+		`ext:function-available(name())`:      LiteralArgError(ClarkName(ExtensionNS, "function-available")),
+		`ext:function-available('x:compare')`: UnresolvedPrefixError("x"),
+	}
+	for xpath, expected := range tests {
+		if _, err := compiler.Compile(xpath); err != expected {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", xpath, expected, err)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	doc := parseXML(t, `<a><b k="2" n="x"/><b k="10" n="y"/><b k="1" n="x"/><b n="z"/></a>`)
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	tests := map[string]string{
+		`ext:sort(//b, '@k')`:                           " 1 10 2",
+		`ext:sort(//b, '@k', 'number')`:                 " 1 2 10",
+		`ext:sort(//b, '@k', 'number', 'descending')`:   "10 2 1 ",
+		`ext:sort(//b, '@n')`:                           "2 1 10 ",
+		`ext:sort(//b, '@n', 'text', 'descending')`:     " 10 2 1",
+		`ext:sort(/a/b[@k], 'count(preceding::b)')`:     "2 10 1",
+		`ext:sort(/a/b[@k], 'position()', 'number')`:    "2 10 1",
+		`ext:sort(/a/b[@k], '-position()', 'number')`:   "1 10 2",
+		`ext:sort(/a/b[@k], 'substring(@k, 1, 1)')`:     "10 1 2",
+		`ext:sort(ext:reverse(/a/b[@k]), 'string(@n)')`: "2 1 10",
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		ns, err := expr.EvalNodeSet(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		var keys []string
+		for _, n := range ns {
+			k := ""
+			if a := n.(*dom.Element).GetAttr("", "k"); a != nil {
+				k = a.Value
+			}
+			keys = append(keys, k)
+		}
+		if actual := strings.Join(keys, " "); actual != expected {
+			t.Errorf("FAIL: xpath: %s\nexpected: %q\nactual: %q", xpath, expected, actual)
+		}
+	}
+
+	errors := map[string]error{
+		`ext:sort(//b, name())`: LiteralArgError(ClarkName(ExtensionNS, "sort")),
+		`ext:sort(//b, 'x:k')`:  UnresolvedPrefixError("x"),
+	}
+	for xpath, expected := range errors {
+		if _, err := compiler.Compile(xpath); err != expected {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", xpath, expected, err)
+		}
+	}
+	if _, err := compiler.Compile(`ext:sort(//b, '@k[')`); err == nil {
+		t.Error("invalid key expression must fail compilation")
+	}
+}
+
+// the first node of node-set returned by ext:reverse and ext:sort
+// is the first in their order, not in document order.
+func TestUnorderedFirstNode(t *testing.T) {
+	doc := parseXML(t, `<a><b k="2">x</b><c k="10">y</c><d k="1">z</d></a>`)
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	tests := map[string]interface{}{
+		`string(ext:reverse(/a/*))`:                "z",
+		`number(ext:reverse(/a/*/@k))`:             float64(1),
+		`name(ext:reverse(/a/*))`:                  "d",
+		`string(ext:sort(/a/*, '@k', 'number'))`:   "z",
+		`name(ext:sort(/a/*, '@k', 'number'))`:     "d",
+		`string(ext:reverse(/a/*)/@k)`:             "2",
+		`name(ext:sort(/a/*, '@k', 'text'))`:       "d",
+		`string(ext:sort(/a/*, 'name()', 'text'))`: "x",
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.Eval(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %s\nexpected: %v\nactual: %v", xpath, expected, actual)
+		}
+	}
+}
+
+func TestRegexGroupInvalidPattern(t *testing.T) {
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	if _, err := compiler.Compile(`ext:regex-group(., '(a', 1)`); err == nil {
+		t.Error("invalid literal pattern must fail compilation")
+	}
+	expr, err := compiler.Compile(`ext:regex-group('a', string(.), 1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.EvalString(parseXML(t, `<a>(a</a>`), nil); err == nil {
+		t.Error("invalid pattern must fail evaluation")
+	}
+}
+
+func TestEvalIn(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b><b>3</b></a>`)
+	ctx := &Context{Node: doc, Pos: 3, Size: 5, Vars: VariableMap{"v": "x"}}
+	tests := map[string]interface{}{
+		`position()`:                  float64(3),
+		`last()`:                      float64(5),
+		`concat($v, last())`:          "x5",
+		`string(/a/b[last()])`:        "3",
+		`count(/a/b[position() < 3])`: float64(2),
+	}
+	for xpath, expected := range tests {
+		expr, err := new(Compiler).Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.EvalIn(ctx)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %v expected: %v actual: %v", xpath, expected, actual)
+		}
+	}
+}
+
+func TestLogicalNodeSetOperands(t *testing.T) {
+	doc := parseXML(t, `<r><a/><b/></r>`)
+	vars := VariableMap{
+		"a":     []dom.Node{doc.ChildNodes[0]},
+		"empty": []dom.Node(nil),
+	}
+	tests := map[string]bool{
+		`//a and //b`:         true,
+		`//a and //c`:         false,
+		`//c or //b`:          true,
+		`//c or //d`:          false,
+		`$a or false()`:       true,
+		`$empty or false()`:   false,
+		`false() or $a`:       true,
+		`true() and $empty`:   false,
+		`not(//a and $empty)`: true,
+	}
+	for xpath, expected := range tests {
+		expr, err := new(Compiler).Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.EvalBoolean(doc, vars)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %v expected: %v actual: %v", xpath, expected, actual)
+		}
+	}
+}
+
+func BenchmarkTranslate(b *testing.B) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("<root>")
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(buf, "<item>abcdef %d cabbage</item>", i)
+	}
+	buf.WriteString("</root>")
+	doc := parseXML(b, buf.String())
+	expr, err := new(Compiler).Compile(`count(//item[translate(., 'abc', 'xyz') = 'xyzdef 0 zxyyxge'])`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := expr.EvalNumber(doc, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != 1 {
+			b.Fatalf("expected 1, but got %v", n)
+		}
+	}
+}
+
+func TestEvalEach(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><c><b>2</b></c><b>3</b></a>`)
+	expr, err := new(Compiler).Compile(`//b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	err = expr.EvalEach(doc, nil, func(n dom.Node) bool {
+		values = append(values, Node2String(n))
+		return len(values) < 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(values, ","); got != "1,2" {
+		t.Errorf("expected 1,2, but got %s", got)
+	}
+
+	expr, err = new(Compiler).Compile(`count(//b)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = expr.EvalEach(doc, nil, func(n dom.Node) bool {
+		t.Error("fn must not be called")
+		return true
+	})
+	if _, ok := err.(ConversionError); !ok {
+		t.Errorf("expected ConversionError, but got %#v", err)
+	}
+}
+
+func TestBaseURI(t *testing.T) {
+	doc := parseXML(t, `<a xml:base="http://example.com/docs/"><b xml:base="guide/"><c id="1" xml:base="../api/index.html"/><d/></b><e/></a>`)
+	tests := []struct {
+		baseURI string
+		xpath   string
+		result  string
+	}{
+		{"", `ext:base-uri(//c)`, "http://example.com/docs/api/index.html"},
+		{"", `ext:base-uri(//c/@id)`, "http://example.com/docs/api/index.html"},
+		{"", `ext:base-uri(//d)`, "http://example.com/docs/guide/"},
+		{"", `ext:base-uri(//e)`, "http://example.com/docs/"},
+		{"", `ext:base-uri(/)`, ""},
+		{"", `ext:base-uri(//x)`, ""},
+		{"", `ext:base-uri()`, ""},
+		{"http://example.com/root.xml", `ext:base-uri()`, "http://example.com/root.xml"},
+		{"http://other.com/", `ext:base-uri(//d)`, "http://example.com/docs/guide/"},
+		{"http://example.com/root.xml", `count(//*[ext:base-uri() = 'http://example.com/docs/guide/'])`, "2"},
+	}
+	for _, test := range tests {
+		c := &Compiler{
+			Namespaces: map[string]string{"ext": ExtensionNS},
+			BaseURI:    test.baseURI,
+		}
+		expr, err := c.Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		actual, err := expr.EvalString(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if actual != test.result {
+			t.Errorf("FAIL: xpath: %s baseURI: %q expected: %q actual: %q", test.xpath, test.baseURI, test.result, actual)
+		}
+	}
+}
+
+func TestStripWhitespace(t *testing.T) {
+	doc := parseXML(t, "<a>\n  <b> </b>\n  <c>\n    <d>x</d>\n  </c>\n</a>")
+	tests := []struct {
+		elements []string
+		xpath    string
+		result   float64
+	}{
+		{nil, `count(/a/node())`, 2},
+		{nil, `count(//text())`, 1},
+		{nil, `count(/a/c/node()[1]/self::d)`, 1},
+		{nil, `count(/a/b/following-sibling::node())`, 1},
+		{nil, `string-length(/a/b)`, 1},
+		{[]string{"c"}, `count(/a/node())`, 5},
+		{[]string{"c"}, `count(//text())`, 5},
+		{[]string{"a", "b"}, `count(//text())`, 3},
+	}
+	for _, test := range tests {
+		c := &Compiler{StripWhitespace: true, StripWhitespaceElements: test.elements}
+		expr, err := c.Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		actual, err := expr.EvalNumber(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if actual != test.result {
+			t.Errorf("FAIL: xpath: %s elements: %v expected: %v actual: %v", test.xpath, test.elements, test.result, actual)
+		}
+	}
+
+	// context node is the stripped text node before <b>
+	text := doc.RootElement().ChildNodes[0]
+	tests = []struct {
+		elements []string
+		xpath    string
+		result   float64
+	}{
+		{nil, `count(self::node())`, 0},
+		{nil, `count(.)`, 0},
+		{nil, `count(self::text())`, 0},
+		{nil, `count(ancestor-or-self::node())`, 2},
+		{nil, `count(../node())`, 2},
+		{[]string{"c"}, `count(self::node())`, 1},
+		{[]string{"c"}, `count(.)`, 1},
+		{[]string{"c"}, `count(ancestor-or-self::node())`, 3},
+	}
+	for _, test := range tests {
+		c := &Compiler{StripWhitespace: true, StripWhitespaceElements: test.elements}
+		expr, err := c.Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		actual, err := expr.EvalNumber(text, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if actual != test.result {
+			t.Errorf("FAIL: xpath: %s elements: %v expected: %v actual: %v", test.xpath, test.elements, test.result, actual)
+		}
+	}
+}
+
+func TestStripWhitespacePreserve(t *testing.T) {
+	doc := parseXML(t, "<a>\n  <pre xml:space=\"preserve\">\n  <b> </b>\n  <c xml:space=\"default\">\n    <d> </d>\n  </c>\n</pre>\n  <e> </e>\n</a>")
+	tests := []struct {
+		elements []string
+		xpath    string
+		result   float64
+	}{
+		{nil, `count(//text())`, 4},
+		{nil, `count(/a/node())`, 2},
+		{nil, `count(/a/pre/node())`, 5},
+		{nil, `count(/a/pre/b/text())`, 1},
+		{nil, `count(/a/pre/c/node())`, 1},
+		{nil, `count(/a/pre/c/d/text())`, 0},
+		{nil, `count(/a/e/text())`, 0},
+		{[]string{"pre", "d"}, `count(/a/pre/node())`, 5},
+		{[]string{"pre", "d"}, `count(/a/pre/c/d/text())`, 0},
+		{[]string{"pre", "d"}, `count(//text())`, 10},
+	}
+	for _, test := range tests {
+		c := &Compiler{StripWhitespace: true, StripWhitespaceElements: test.elements}
+		expr, err := c.Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		actual, err := expr.EvalNumber(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if actual != test.result {
+			t.Errorf("FAIL: xpath: %s elements: %v expected: %v actual: %v", test.xpath, test.elements, test.result, actual)
+		}
+	}
+}
+
+func TestContextRoot(t *testing.T) {
+	doc := parseXML(t, `<x><frag><a>1</a><b><a>2</a></b></frag></x>`)
+	frag := doc.RootElement().ChildNodes[0].(*dom.Element)
+	frag.ParentNode = nil // detach
+	tests := map[string]interface{}{
+		`string(/a)`:           "1",
+		`count(//a)`:           float64(2),
+		`count(/frag)`:         float64(0),
+		`name(/)`:              "frag",
+		`string(/b/a/../../a)`: "1",
+		`sum(//a[. > 1])`:      float64(2),
+	}
+	for xpath, expected := range tests {
+		expr, err := new(Compiler).Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.EvalIn(&Context{Node: frag, Size: 1, Root: frag})
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %v expected: %v actual: %v", xpath, expected, actual)
+		}
+	}
+}
+
+type prefixFunctions string
+
+func (p prefixFunctions) Resolve(function string) *Function {
+	if !strings.HasPrefix(function, "{"+string(p)+"}") {
+		return nil
+	}
+	name := function[len(p)+2:]
+	return &Function{String, nil, CompileFunc(func(args []interface{}) interface{} {
+		return "custom:" + name
+	})}
+}
+
+func TestFunctionLibrary(t *testing.T) {
+	constant := func(s string) *Function {
+		return &Function{String, nil, CompileFunc(func(args []interface{}) interface{} {
+			return s
+		})}
+	}
+	compiler := &Compiler{
+		Namespaces: map[string]string{"x": "www.example.com"},
+		Functions: FunctionLibrary{
+			FunctionMap{
+				"{www.example.com}f1": constant("map1:f1"),
+			},
+			FunctionMap{
+				"{www.example.com}f1": constant("map2:f1"),
+				"{www.example.com}f2": constant("map2:f2"),
+			},
+			prefixFunctions("www.example.com"),
+		},
+	}
+	tests := map[string]string{
+		`x:f1()`:              "map1:f1",
+		`x:f2()`:              "map2:f2",
+		`x:f3()`:              "custom:f3",
+		`concat(x:f2(), '!')`: "map2:f2!",
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.EvalString(nil, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %v expected: %v actual: %v", xpath, expected, actual)
+		}
+	}
+
+	if _, err := compiler.Compile(`x:f1(1)`); err == nil {
+		t.Error("error expected for wrong argument count")
+	}
+	if _, err := (&Compiler{Functions: FunctionLibrary{}}).Compile(`unknown()`); err == nil {
+		t.Error("error expected for unresolved function")
+	}
+}
+
+func TestEvalNodeSetAny(t *testing.T) {
+	doc := parseXML(t, `<a><b/><b/></a>`)
+	vars := VariableMap{
+		"ns":  []dom.Node{doc.RootElement()},
+		"str": "b",
+	}
+	expr, err := new(Compiler).Compile(`$ns`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.Returns() != Any {
+		t.Fatalf("expected Any, but got %v", expr.Returns())
+	}
+	ns, err := expr.EvalNodeSet(doc, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ns) != 1 || ns[0] != doc.RootElement() {
+		t.Errorf("expected root element, but got %v", ns)
+	}
+
+	expr, err = new(Compiler).Compile(`$str`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = expr.EvalNodeSet(doc, vars); err != (ConversionError{String, NodeSet}) {
+		t.Errorf("expected ConversionError, but got %#v", err)
+	}
+	if s, err := expr.EvalString(doc, vars); err != nil || s != "b" {
+		t.Errorf("expected b, but got %q, %v", s, err)
+	}
+}
+
+func TestLastInFilterOverVariable(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b><b>3</b><b>4</b></a>`)
+	expr, err := new(Compiler).Compile(`//b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := expr.EvalNodeSet(doc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars := VariableMap{"nodes": nodes}
+	tests := map[string]interface{}{
+		`string($nodes[position() = last()])`:        "4",
+		`string($nodes[last()])`:                     "4",
+		`string($nodes[last() - 1])`:                 "3",
+		`string($nodes[position() < 3][last()])`:     "2",
+		`string($nodes[. > 1][position() = last()])`: "4",
+		`count($nodes[last() = 4])`:                  float64(4),
+		`count($nodes[position() > last() div 2])`:   float64(2),
+		`last()`: float64(1),
+	}
+	for xpath, expected := range tests {
+		expr, err := new(Compiler).Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.Eval(doc, vars)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %v expected: %v actual: %v", xpath, expected, actual)
+		}
+	}
+}
+
+func TestEvalResult(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b></a>`)
+	expr, err := new(Compiler).Compile(`//b`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := expr.EvalResult(doc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type() != NodeSet {
+		t.Errorf("expected node-set, but got %v", r.Type())
+	}
+	if ns, err := r.NodeSet(); err != nil || len(ns) != 2 {
+		t.Errorf("expected 2 nodes, but got %v, %v", ns, err)
+	}
+	if r.String() != "1" || r.Number() != 1 || !r.Boolean() {
+		t.Errorf("got %q %v %v", r.String(), r.Number(), r.Boolean())
+	}
+
+	expr, err = new(Compiler).Compile(`count(//b) * 1.5`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = expr.EvalResult(doc, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.Type() != Number || r.Value() != float64(3) {
+		t.Errorf("expected number 3, but got %v %v", r.Type(), r.Value())
+	}
+	if _, err := r.NodeSet(); err != (ConversionError{Number, NodeSet}) {
+		t.Errorf("expected ConversionError, but got %#v", err)
+	}
+	if r.String() != "3" || !r.Boolean() {
+		t.Errorf("got %q %v", r.String(), r.Boolean())
+	}
+
+	expr, err = new(Compiler).Compile(`$x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = expr.EvalResult(doc, VariableMap{}); err == nil {
+		t.Error("error expected for unresolved variable")
+	}
+}
+
+func TestDefaultLang(t *testing.T) {
+	doc := parseXML(t, `<a><b xml:lang="fr"><c/></b><d/></a>`)
+	tests := []struct {
+		defaultLang string
+		xpath       string
+		result      float64
+	}{
+		{"", `count(//*[lang('en')])`, 0},
+		{"", `count(//*[lang('fr')])`, 2},
+		{"en-US", `count(//*[lang('en')])`, 2},
+		{"en-US", `count(//*[lang('EN-us')])`, 2},
+		{"en-US", `count(//*[lang('en-GB')])`, 0},
+		{"en-US", `count(//*[lang('fr')])`, 2},
+		{"en-US", `count(//d[lang('en')])`, 1},
+		{"en-US", `count(//c[lang('en')])`, 0},
+	}
+	for _, test := range tests {
+		c := &Compiler{DefaultLang: test.defaultLang}
+		expr, err := c.Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		actual, err := expr.EvalNumber(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if actual != test.result {
+			t.Errorf("FAIL: xpath: %s defaultLang: %q expected: %v actual: %v", test.xpath, test.defaultLang, test.result, actual)
+		}
+	}
+}
+
+func BenchmarkDescendants(b *testing.B) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("<root>")
+	for i := 0; i < 10000; i++ {
+		buf.WriteString("<section><title>title</title><p>para <b>bold</b> text</p><p>another <i>para</i></p></section>")
+	}
+	buf.WriteString("</root>")
+	doc := parseXML(b, buf.String())
+	expr, err := new(Compiler).Compile(`count(/descendant::node())`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := expr.EvalNumber(doc, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != 120001 {
+			b.Fatalf("expected 120001, but got %v", n)
+		}
+	}
+}
+
+func BenchmarkDescendantName(b *testing.B) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("<root>")
+	for i := 0; i < 5000; i++ {
+		buf.WriteString("<node><a>text</a><b>text</b><leaf/><c>text</c></node>")
+	}
+	buf.WriteString("</root>")
+	doc := parseXML(b, buf.String())
+	expr, err := new(Compiler).Compile(`//leaf`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ns, err := expr.EvalNodeSet(doc, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(ns) != 5000 {
+			b.Fatalf("expected 5000 nodes, but got %d", len(ns))
+		}
+	}
+}
+
+func TestInternNames(t *testing.T) {
+	doc := parseXML(t, `<a xmlns:p="urn:p"><b x="1"/><p:b p:x="2"/><bb xx="3"/><c/></a>`)
+	compiler := &Compiler{
+		Namespaces:  map[string]string{"p": "urn:p"},
+		InternNames: internNames(doc),
+	}
+	tests := map[string]string{
+		`count(//b)`:        "1",
+		`count(//p:b)`:      "1",
+		`count(//*/@x)`:     "1",
+		`string(//@p:x)`:    "2",
+		`count(//bb[@xx])`:  "1",
+		`count(//d)`:        "0",
+		`count(/a/*[@x])`:   "1",
+		`count(//b | //bb)`: "2",
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.EvalString(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %s\nexpected: %s\nactual: %s", xpath, expected, actual)
+		}
+	}
+
+	// names of other documents are not interned by the same function
+	other := parseXML(t, `<a xmlns:p="urn:p"><b x="1"/><p:b p:x="2"/><bb xx="3"/><c/></a>`)
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.EvalString(other, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %s with other document\nexpected: %s\nactual: %s", xpath, expected, actual)
+		}
+	}
+}
+
+// internNames interns the element and attribute names in the document
+// and returns the function that interns with the same table.
+func internNames(d *dom.Document) func(string) string {
+	table := make(map[string]string)
+	intern := func(s string) string {
+		if t, ok := table[s]; ok {
+			return t
+		}
+		table[s] = s
+		return s
+	}
+	var walk func(n dom.Node)
+	walk = func(n dom.Node) {
+		if e, ok := n.(*dom.Element); ok {
+			e.URI, e.Local = intern(e.URI), intern(e.Local)
+			for _, a := range e.Attrs {
+				a.URI, a.Local = intern(a.URI), intern(a.Local)
+			}
+		}
+		if p, ok := n.(dom.Parent); ok {
+			for _, c := range p.Children() {
+				walk(c)
+			}
+		}
+	}
+	walk(d)
+	return intern
+}
+
+func BenchmarkNameTest(b *testing.B) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(`<root xmlns:ns="http://www.example.com/namespaces/items">`)
+	for i := 0; i < 500; i++ {
+		for j := 0; j < 10; j++ {
+			buf.WriteString("<ns:elemenu><ns:elemenv>")
+		}
+		buf.WriteString("<ns:element/>")
+		for j := 0; j < 10; j++ {
+			buf.WriteString("</ns:elemenv></ns:elemenu>")
+		}
+	}
+	buf.WriteString("</root>")
+	doc := parseXML(b, buf.String())
+	run := func(b *testing.B, compiler *Compiler) {
+		compiler.Namespaces = map[string]string{"ns": "http://www.example.com/namespaces/items"}
+		expr, err := compiler.Compile(`count(//ns:element)`)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			n, err := expr.EvalNumber(doc, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n != 500 {
+				b.Fatalf("expected 500, but got %v", n)
+			}
+		}
+	}
+	b.Run("strings", func(b *testing.B) {
+		run(b, new(Compiler))
+	})
+	b.Run("interned", func(b *testing.B) {
+		intern := internNames(doc)
+		run(b, &Compiler{InternNames: intern})
+	})
+}
+
+func BenchmarkOrderSiblings(b *testing.B) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("<root>")
+	for i := 0; i < 2500; i++ {
+		buf.WriteString("<a/><b/>")
+	}
+	buf.WriteString("</root>")
+	doc := parseXML(b, buf.String())
+	expr, err := new(Compiler).Compile(`/root/b | /root/a`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ns, err := expr.EvalNodeSet(doc, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(ns) != 5000 {
+			b.Fatalf("expected 5000 nodes, but got %d", len(ns))
+		}
+	}
+}
+
+func BenchmarkEvalLoop(b *testing.B) {
+	doc := parseXML(b, `<a><b id="1">x</b><b id="2">y</b><b id="3">z</b></a>`)
+	expr, err := new(Compiler).Compile(`string(/a/b[@id > 1][last()])`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := expr.EvalString(doc, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if s != "z" {
+			b.Fatalf("expected z, but got %q", s)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	doc := parseXML(t, `<a><p><b/></p><p><b/></p><p><b/><c/></p></a>`)
+	calls := 0
+	compiler := &Compiler{
+		Namespaces: map[string]string{"x": "www.example.com"},
+		Functions: FunctionMap{
+			"{www.example.com}check": &Function{Boolean, nil, CompileFunc(func(args []interface{}) interface{} {
+				calls++
+				return true
+			})},
+		},
+	}
+	tests := map[string]bool{
+		`//b[x:check()]`:       true,
+		`//p[b][c]`:            true,
+		`//p[d] | //b[c]`:      false,
+		`//p[d] | //p/c`:       true,
+		`/a/p[2]/b`:            true,
+		`/a/p[4]`:              false,
+		`//p[not(b)]`:          false,
+		`count(//b) = 3`:       true,
+		`string(/a)`:           false,
+		`boolean(//b/../c)`:    true,
+		`//c/preceding::b[10]`: false,
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		calls = 0
+		actual, err := expr.Matches(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %v expected: %v actual: %v", xpath, expected, actual)
+		}
+		if calls > 1 {
+			t.Errorf("FAIL: xpath: %v predicate evaluated %d times", xpath, calls)
+		}
+		if b, err := expr.EvalBoolean(doc, nil); err != nil || b != expected {
+			t.Errorf("FAIL: xpath: %v EvalBoolean returned %v, %v", xpath, b, err)
+		}
+	}
+}
+
+func BenchmarkNumericJoin(b *testing.B) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("<root>")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(buf, `<row v="%d.5"/>`, i)
+	}
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(buf, `<threshold v="%d"/>`, 180+i)
+	}
+	buf.WriteString("</root>")
+	doc := parseXML(b, buf.String())
+	expr, err := new(Compiler).Compile(`count(//row[@v > //threshold/@v])`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := expr.EvalNumber(doc, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != 20 {
+			b.Fatalf("expected 20, but got %v", n)
+		}
+	}
+}
+
+func TestOnWarning(t *testing.T) {
+	tests := map[string]int{
+		`/a/b[@c]`:                              0,
+		`//text()`:                              0,
+		`@x/..`:                                 0,
+		`text()/following::a`:                   0,
+		`@x/self::node()`:                       0,
+		`attribute::text()`:                     1,
+		`namespace::comment()`:                  1,
+		`@*/processing-instruction()`:           1,
+		`text()/@x`:                             1,
+		`comment()/*`:                           1,
+		`@x/descendant::a/@y`:                   1,
+		`a[text()/b]/namespace::*`:              1,
+		`@x/a | processing-instruction('p')//b`: 2,
+	}
+	for xpath, expected := range tests {
+		var warnings []string
+		c := &Compiler{OnWarning: func(msg string) {
+			warnings = append(warnings, msg)
+		}}
+		if _, err := c.Compile(xpath); err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if len(warnings) != expected {
+			t.Errorf("FAIL: xpath: %s expected %d warnings, but got %q", xpath, expected, warnings)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	compiler := &Compiler{Namespaces: map[string]string{
+		"x": "www.example.com",
+		"y": "www.example.com",
+	}}
+	tests := [][]string{
+		{`/a/b`, ` / a / b `, `/child::a/child::b`, `(/a/b)`},
+		{`//a[@id = 1]`, `/descendant-or-self::node()/a[(attribute::id=1)]`},
+		{`1 + 2 * 3`, `1+(2*3)`, `((1 + (2 * 3)))`},
+		{`x:a/@x:b[. = $x:v]`, `y:a/attribute::y:b[self::node() = $y:v]`},
+		{`(//a)[1]/.`, `( //a )[ 1 ]/self::node()`},
+		{`concat('a', "b")`, `concat( "a" , 'b' )`},
+	}
+	for _, test := range tests {
+		var canonical string
+		for i, xpath := range test {
+			expr, err := compiler.Compile(xpath)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", xpath, err)
+				continue
+			}
+			if i == 0 {
+				canonical = expr.Canonical()
+			} else if expr.Canonical() != canonical {
+				t.Errorf("FAIL: canonical of %s is %q, but %s is %q", xpath, expr.Canonical(), test[0], canonical)
+			}
+		}
+	}
+
+	distinct := map[string]string{}
+	for _, xpath := range []string{`/a/b`, `a/b`, `/a//b`, `(1 + 2) * 3`, `1 + 2 * 3`, `x:a`, `a`, `'1'`, `1`} {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if other, ok := distinct[expr.Canonical()]; ok {
+			t.Errorf("FAIL: %s and %s have same canonical form %q", xpath, other, expr.Canonical())
+		}
+		distinct[expr.Canonical()] = xpath
+	}
+}
+
+func TestBatchEval(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b><c>x</c></a>`)
+	xs, err := new(Compiler).CompileBatch([]string{`count(//b)`, `string(/a)`, `//b[. = 2]`, `/a/c = 'x'`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := BatchEval(doc, nil, xs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 4 {
+		t.Fatalf("expected 4 results, but got %d", len(r))
+	}
+	if r[0] != float64(2) || r[1] != "12x" || r[3] != true {
+		t.Errorf("got %v", r)
+	}
+	if ns, ok := r[2].([]dom.Node); !ok || len(ns) != 1 || Node2String(ns[0]) != "2" {
+		t.Errorf("got %v", r[2])
+	}
+
+	if _, err := new(Compiler).CompileBatch([]string{`/a`, `/a[`, `unknown()`}); err == nil {
+		t.Error("error expected for invalid xpath")
+	}
+
+	xs, err = new(Compiler).CompileBatch([]string{`/a`, `$v`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := BatchEval(doc, VariableMap{}, xs); err == nil || r != nil {
+		t.Errorf("expected error for unresolved variable, but got %v, %v", r, err)
+	}
+}
+
+func TestOrderSharesIndex(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b><c>x</c></a>`)
+	children := doc.RootElement().ChildNodes
+	state := new(evalState)
+	ctx := newContext(doc, 1, 1, nil, nil, state)
+	defer releaseContext(ctx)
+
+	ns := []dom.Node{children[2], children[0], children[1]}
+	order(ns, ctx)
+	for i, n := range ns {
+		if n != children[i] {
+			t.Fatalf("node at %d is not in document order", i)
+		}
+	}
+	if len(state.index) != 3 {
+		t.Fatalf("expected 3 positions cached, but got %d", len(state.index))
+	}
+
+	// cached positions are used by next sort
+	state.index[children[0]], state.index[children[2]] = 2, 0
+	ns = []dom.Node{children[0], children[2]}
+	order(ns, ctx)
+	if ns[0] != children[2] {
+		t.Error("cached positions are not used")
+	}
+}
+
+func TestMaxNodesVisited(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("<a>")
+	for i := 0; i < 50; i++ {
+		buf.WriteString("<b><c><d/></c></b>")
+	}
+	buf.WriteString("</a>")
+	doc := parseXML(t, buf.String())
+	tests := []struct {
+		xpath string
+		max   int
+		err   bool
+	}{
+		{`count(//*)`, 0, false},
+		{`count(//*[.//*[.//*]])`, 0, false},
+		{`count(//*)`, 1000, false},
+		{`count(/a/b)`, 51, false},
+		{`count(/a/b)`, 50, true},
+		{`count(//*[.//*[.//*]])`, 1000, true},
+		{`boolean(//d)`, 100, false},
+	}
+	for _, test := range tests {
+		expr, err := (&Compiler{MaxNodesVisited: test.max}).Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		for i := 0; i < 2; i++ {
+			_, err = expr.Eval(doc, nil)
+			if test.err {
+				if err != BudgetExceededError(test.max) {
+					t.Errorf("FAIL: %s with budget %d: expected BudgetExceededError, but got %v", test.xpath, test.max, err)
+				}
+			} else if err != nil {
+				t.Errorf("FAIL: %s with budget %d: %v", test.xpath, test.max, err)
+			}
+		}
+	}
+}
+
+type concatIter []Iterator
+
+func (iter *concatIter) Next() dom.Node {
+	for len(*iter) > 0 {
+		if n := (*iter)[0].Next(); n != nil {
+			return n
+		}
+		*iter = (*iter)[1:]
+	}
+	return nil
+}
+
+func TestAxes(t *testing.T) {
+	doc := parseXML(t, `<a><b/><c><d/></c><e/></a>`)
+	compiler := &Compiler{
+		Namespaces: map[string]string{"axis": AxisNS},
+		Axes: map[string]func(dom.Node) Iterator{
+			"siblings": func(n dom.Node) Iterator {
+				return &concatIter{PrecedingSiblingAxis(n), FollowingSiblingAxis(n)}
+			},
+		},
+	}
+	tests := map[string]string{
+		`count(axis:siblings(/a/c))`:                 "2",
+		`name(axis:siblings(/a/c)[1])`:               "b",
+		`name(axis:siblings(/a/c)[last()])`:          "e",
+		`count(axis:siblings(/a/*))`:                 "3",
+		`count(axis:siblings(//d))`:                  "0",
+		`count(/a/*[count(axis:siblings()) = 2])`:    "3",
+		`name(/a/c[axis:siblings()[self::e]])`:       "c",
+		`count(axis:siblings(/a/b)[self::e] | /a/c)`: "2",
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.EvalString(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %s\nexpected: %s\nactual: %s", xpath, expected, actual)
+		}
+	}
+
+	if _, err := compiler.Compile(`axis:cousins()`); err != UnresolvedFunctionError(ClarkName(AxisNS, "cousins")) {
+		t.Errorf("expected UnresolvedFunctionError, but got %v", err)
+	}
+	if _, err := compiler.Compile(`axis:siblings(., .)`); err != ArgCountError(ClarkName(AxisNS, "siblings")) {
+		t.Errorf("expected ArgCountError, but got %v", err)
+	}
+}
+
+func TestAllowedAxes(t *testing.T) {
+	doc := parseXML(t, `<a><b><x/></b><x/></a>`)
+	compiler := &Compiler{
+		AllowedAxes: map[string]bool{"child": true, "attribute": true, "self": true, "parent": true},
+	}
+	tests := map[string]error{
+		`//x`:                      DisallowedAxisError("descendant-or-self"),
+		`/descendant::x`:           DisallowedAxisError("descendant"),
+		`/a/following::x`:          DisallowedAxisError("following"),
+		`count(/a/b/preceding::*)`: DisallowedAxisError("preceding"),
+		`/a[b//x]`:                 DisallowedAxisError("descendant-or-self"),
+		`/a/x | /a/ancestor::*`:    DisallowedAxisError("ancestor"),
+		`/a/b/x`:                   nil,
+		`/a/b/../x/.`:              nil,
+		`/a[@id or b]/x`:           nil,
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != expected {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", xpath, expected, err)
+			continue
+		}
+		if err == nil {
+			if _, err := expr.Eval(doc, nil); err != nil {
+				t.Errorf("FAIL: %s: %v", xpath, err)
+			}
+		}
+	}
+
+	compiler.AllowedAxes["descendant-or-self"] = true
+	if _, err := compiler.Compile(`//x`); err != nil {
+		t.Errorf("FAIL: //x: %v", err)
+	}
+}
+
+func TestCompileExpr(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b></a>`)
+	compiler := &Compiler{Namespaces: map[string]string{"p": "urn:p"}}
+	tests := []string{
+		`count(/a/b)`,
+		`sum(//b) * 2`,
+		`/a/b[. = 2]`,
+		`concat(string(//b[1]), '-', //b[last()])`,
+	}
+	for _, str := range tests {
+		e, err := xpathparser.Parse(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x1, err := compiler.CompileExpr(e)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", str, err)
+			continue
+		}
+		x2, err := compiler.Compile(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x1.String() != fmt.Sprint(e) {
+			t.Errorf("FAIL: %s: String() expected: %s actual: %s", str, e, x1)
+		}
+		if x1.Canonical() != x2.Canonical() {
+			t.Errorf("FAIL: %s: Canonical() expected: %s actual: %s", str, x2.Canonical(), x1.Canonical())
+		}
+		r1, err1 := x1.EvalResult(doc, nil)
+		r2, err2 := x2.EvalResult(doc, nil)
+		if err1 != nil || err2 != nil || r1.String() != r2.String() {
+			t.Errorf("FAIL: %s: expected: %v actual: %v", str, r2, r1)
+		}
+	}
+
+	e, err := xpathparser.Parse(`q:x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compiler.CompileExpr(e); err != UnresolvedPrefixError("q") {
+		t.Errorf("expected UnresolvedPrefixError, but got %v", err)
+	}
+}
+
+func TestAttributeOrder(t *testing.T) {
+	doc := parseXML(t, `<a z="1" b="2" m="3"><c y="4" x="5"/></a>`)
+	tests := []struct {
+		xpath  string
+		byName string
+		byDecl string
+	}{
+		{`//@*`, "b m z x y", "z b m y x"},
+		{`/a/@m | /a/@z`, "m z", "z m"},
+		{`/a/@* | /a/c`, "b m z c", "z b m c"},
+		{`//c/@* | /a/@b`, "b x y", "b y x"},
+		{`/a/@*`, "b m z", "z b m"},
+	}
+	for _, test := range tests {
+		for _, order := range []AttributeOrder{"", AttrNameOrder, AttrDocumentOrder} {
+			expr, err := (&Compiler{AttributeOrder: order}).Compile(test.xpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns, err := expr.EvalNodeSet(doc, nil)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", test.xpath, err)
+				continue
+			}
+			var names []string
+			for _, n := range ns {
+				switch n := n.(type) {
+				case *dom.Attr:
+					names = append(names, n.Local)
+				case *dom.Element:
+					names = append(names, n.Local)
+				}
+			}
+			expected := test.byName
+			if order == AttrDocumentOrder {
+				expected = test.byDecl
+			}
+			if actual := strings.Join(names, " "); actual != expected {
+				t.Errorf("FAIL: xpath: %s order: %q\nexpected: %s\nactual: %s", test.xpath, order, expected, actual)
+			}
+		}
+	}
+	for _, order := range []AttributeOrder{"Document", "doc", "names"} {
+		_, err := (&Compiler{AttributeOrder: order}).Compile("//@*")
+		if err != AttributeOrderError(order) {
+			t.Errorf("AttributeOrder %q: expected AttributeOrderError, but got %v", order, err)
+		}
+	}
+}
+
+func TestLazyVariables(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b><b>3</b></a>`)
+	calls := make(map[string]int)
+	vars := LazyVariables(func(variable string) interface{} {
+		calls[variable]++
+		switch variable {
+		case "x":
+			return float64(2)
+		case "unused":
+			t.Error("unreferenced variable must not be computed")
+			return "unused"
+		}
+		return nil
+	})
+	tests := map[string]string{
+		`$x`:                            "2",
+		`$x + $x * $x`:                  "6",
+		`count(/a/b[. >= $x])`:          "2",
+		`string(/a/b[position() = $x])`: "2",
+		`concat($x, /a/b[. = $x], $x)`:  "222",
+		`count(//b[$x = . or $x > . ])`: "2",
+		`sum(/a/b[. != $x]) + $x`:       "6",
+	}
+	for xpath, expected := range tests {
+		expr, err := new(Compiler).Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		for i := 1; i <= 2; i++ {
+			actual, err := expr.EvalString(doc, vars)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", xpath, err)
+				continue
+			}
+			if actual != expected {
+				t.Errorf("FAIL: xpath: %s\nexpected: %s\nactual: %s", xpath, expected, actual)
+			}
+			if calls["x"] != i {
+				t.Errorf("FAIL: %s: $x computed %d times in %d evaluations", xpath, calls["x"], i)
+			}
+		}
+		calls = make(map[string]int)
+	}
+
+	expr, err := new(Compiler).Compile(`$y or $y`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expr.Eval(doc, vars); err != UnresolvedVariableError("y") {
+		t.Errorf("expected UnresolvedVariableError, but got %v", err)
+	}
+	if calls["y"] != 1 {
+		t.Errorf("missing variable computed %d times", calls["y"])
+	}
+}
+
+func TestNodePath(t *testing.T) {
+	doc := parseXML(t, `<?pi x?><a xmlns:p="urn:p"><p:b x="1" p:y="2">t1<!--c-->t2<?pi y?></p:b><b/><p:b/><!--c--><?pi z?></a>`)
+	compiler := &Compiler{Namespaces: map[string]string{"p": "urn:p"}}
+	all, err := compiler.Compile(`//node() | //@*`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := all.EvalNodeSet(doc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range ns {
+		path := NodePath(n)
+		expr, err := compiler.Compile(path)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", path, err)
+			continue
+		}
+		r, err := expr.EvalNodeSet(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", path, err)
+			continue
+		}
+		if len(r) != 1 || r[0] != n {
+			t.Errorf("FAIL: %s selected %d nodes", path, len(r))
+		}
+	}
+	if path := NodePath(doc.ChildNodes[1].(*dom.Element).Children()[0]); path != "/a[1]/p:b[1]" {
+		t.Errorf("FAIL: expected /a[1]/p:b[1], but got %s", path)
+	}
+
+	// detached tree
+	a := doc.ChildNodes[1].(*dom.Element)
+	a.ParentNode = nil
+	for _, n := range ns[1:] {
+		if n == a {
+			if path := NodePath(n); path != "." {
+				t.Errorf("FAIL: expected ., but got %s", path)
+			}
+			continue
+		}
+		path := NodePath(n)
+		expr, err := compiler.Compile(path)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", path, err)
+			continue
+		}
+		r, err := expr.EvalNodeSet(a, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", path, err)
+			continue
+		}
+		if len(r) != 1 || r[0] != n {
+			t.Errorf("FAIL: %s selected %d nodes", path, len(r))
+		}
+	}
+	if path := NodePath(&dom.Element{Name: &dom.Name{Local: "x"}}); path != "." {
+		t.Errorf("FAIL: expected ., but got %s", path)
+	}
+	if path := NodePath(&dom.Attr{Name: &dom.Name{Local: "x"}}); path != "." {
+		t.Errorf("FAIL: expected ., but got %s", path)
+	}
+}
+
+func TestIndexOf(t *testing.T) {
+	doc := parseXML(t, `<a x="1">t<b/><!--c--><b/></a>`)
+	tests := map[string][]int{
+		`/`:               {-1},
+		`/a`:              {1},
+		`/a/node()`:       {1, 2, 3, 4},
+		`/a/b`:            {2, 4},
+		`/a/@x`:           {-1},
+		`/a/namespace::*`: {-1},
+		`//b | /a/text()`: {1, 2, 4},
+	}
+	for xpath, expected := range tests {
+		expr, err := new(Compiler).Compile(xpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ns, err := expr.EvalNodeSet(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		var actual []int
+		for _, n := range ns {
+			actual = append(actual, IndexOf(n))
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("FAIL: xpath: %s\nexpected: %v\nactual: %v", xpath, expected, actual)
+		}
+	}
+	if i := IndexOf(&dom.Element{Name: &dom.Name{Local: "x"}}); i != -1 {
+		t.Errorf("FAIL: detached element: expected -1, but got %d", i)
+	}
+}
+
+func TestXPathSet(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b></a>`)
+	compiler := &Compiler{
+		Functions: FunctionMap{
+			"fail": {Boolean, Args{Mandatory(NodeSet)}, CompileFunc(func(args []interface{}) interface{} {
+				panic(errors.New("must not be evaluated"))
+			})},
+		},
+	}
+	compile := func(strs ...string) XPathSet {
+		var xs XPathSet
+		for _, str := range strs {
+			x, err := compiler.Compile(str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			xs = append(xs, x)
+		}
+		return xs
+	}
+	tests := []struct {
+		xs          XPathSet
+		any, anyErr bool
+		all, allErr bool
+	}{
+		{compile(), false, false, true, false},
+		{compile(`/a/b`, `count(//b) = 2`), true, false, true, false},
+		{compile(`/a/c`, `/a/b = 2`), true, false, false, false},
+		{compile(`/a/c`, `/a/b = 3`), false, false, false, false},
+		{compile(`/a/b`, `fail(.)`), true, false, false, true},
+		{compile(`/a/c`, `fail(.)`), false, true, false, false},
+		{compile(`fail(.)`, `/a/b`), false, true, false, true},
+	}
+	for i, test := range tests {
+		any, err := test.xs.AnyMatch(doc, nil)
+		if (err != nil) != test.anyErr || any != test.any {
+			t.Errorf("FAIL: #%d AnyMatch: expected %v, got %v, %v", i, test.any, any, err)
+		}
+		all, err := test.xs.AllMatch(doc, nil)
+		if (err != nil) != test.allErr || all != test.all {
+			t.Errorf("FAIL: #%d AllMatch: expected %v, got %v, %v", i, test.all, all, err)
+		}
+	}
+}
+
+func TestStrictNumeric(t *testing.T) {
+	doc := parseXML(t, `<a><n>0</n><n>4</n><n>x</n></a>`)
+	tests := []struct {
+		xpath  string
+		result string
+		err    error
+	}{
+		{`8 div /a/n[2]`, "2", nil},
+		{`9 mod /a/n[2]`, "1", nil},
+		{`1 div /a/n[1]`, "Infinity", DivideByZeroError("div")},
+		{`-1 div /a/n[1]`, "-Infinity", DivideByZeroError("div")},
+		{`0 div /a/n[1]`, "NaN", DivideByZeroError("div")},
+		{`1 mod /a/n[1]`, "NaN", DivideByZeroError("mod")},
+		{`1 div -/a/n[1]`, "-Infinity", DivideByZeroError("div")},
+		{`1 div /a/n[3]`, "NaN", nil},
+		{`/a/n[1] * 1 div 2`, "0", nil},
+		{`count(/a/n[4 div . = 1])`, "1", DivideByZeroError("div")},
+	}
+	for _, test := range tests {
+		for _, strict := range []bool{false, true} {
+			expr, err := (&Compiler{StrictNumeric: strict}).Compile(test.xpath)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", test.xpath, err)
+				continue
+			}
+			actual, err := expr.EvalString(doc, nil)
+			if strict && test.err != nil {
+				if err != test.err {
+					t.Errorf("FAIL: %s: expected error %v, but got %v", test.xpath, test.err, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("FAIL: %s strict=%v: %v", test.xpath, strict, err)
+			} else if actual != test.result {
+				t.Errorf("FAIL: xpath: %s strict=%v\nexpected: %s\nactual: %s", test.xpath, strict, test.result, actual)
+			}
+		}
+	}
+
+	if _, err := (&Compiler{StrictNumeric: true}).Compile(`0 div 0`); err != DivideByZeroError("div") {
+		t.Errorf("FAIL: 0 div 0: expected DivideByZeroError, but got %v", err)
+	}
+	expr, err := new(Compiler).Compile(`0 div 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := expr.EvalNumber(doc, nil); err != nil || !math.IsNaN(r) {
+		t.Errorf("FAIL: 0 div 0: expected NaN, but got %v, %v", r, err)
+	}
+}
+
+func TestEvalStrings(t *testing.T) {
+	doc := parseXML(t, `<a id="1"><b id="3">x<c>y</c></b><b id="2">z</b><d/></a>`)
+	tests := map[string][]string{
+		`//@id`:               {"1", "3", "2"},
+		`/a/b`:                {"xy", "z"},
+		`/a/b[2] | /a/b[1]`:   {"xy", "z"},
+		`//text()`:            {"x", "y", "z"},
+		`/a/d`:                {""},
+		`/a/e`:                {},
+		`count(//b)`:          {"2"},
+		`//b/@id = 2`:         {"true"},
+		`concat(/a/@id, '!')`: {"1!"},
+		`$v`:                  {"z", "xy"},
+	}
+	vars := VariableMap{"v": []dom.Node{doc.ChildNodes[0].(*dom.Element).Children()[1], doc.ChildNodes[0].(*dom.Element).Children()[0]}}
+	for xpath, expected := range tests {
+		expr, err := new(Compiler).Compile(xpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := expr.EvalStrings(doc, vars)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if fmt.Sprintf("%q", actual) != fmt.Sprintf("%q", expected) {
+			t.Errorf("FAIL: xpath: %s\nexpected: %q\nactual: %q", xpath, expected, actual)
+		}
+	}
+}
+
+func TestOuterPosition(t *testing.T) {
+	doc := parseXML(t, `<r><g id="1"><i>a</i><i>b</i></g><g id="2"><i>c</i><i>d</i><i>e</i></g></r>`)
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	tests := map[string]string{
+		`count(/r/g[i[position() = 1]])`:                                      "2",
+		`count(/r/g[i[position() = 3]])`:                                      "1",
+		`string(/r/g[i[ext:position(0) = 3]]/@id)`:                            "2",
+		`string(/r/g[i[ext:position(1) = 2 and . = 'd']]/@id)`:                "2",
+		`count(/r/g[i[ext:position(1) = 1 and . = 'd']])`:                     "0",
+		`count(/r/g[count(i[ext:position(1) < position()]) = 1])`:             "2",
+		`count(/r[g[i[ext:position(2) = 1]]])`:                                "1",
+		`count(/r[g[i[ext:position(3) = 1]]])`:                                "0",
+		`string(/r/g[i[last() = 3 and ext:position(1) = 2]]/@id)`:             "2",
+		`count(/r/g[1]/i[ext:position(1) = 1])`:                               "0",
+		`ext:position(1)`:                                                     "NaN",
+		`count(/r/g[ext:position(0.5)])`:                                      "0",
+		`count(/r/g[ext:position(-1)])`:                                       "0",
+		`count(/r/g[ext:position(0)])`:                                        "2",
+		`string(ext:sort(/r/g/i, 'ext:position(0)', 'number', 'descending'))`: "e",
+	}
+	for xpath, expected := range tests {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		actual, err := expr.EvalString(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if actual != expected {
+			t.Errorf("FAIL: xpath: %s\nexpected: %s\nactual: %s", xpath, expected, actual)
+		}
+	}
+}
+
+func TestEvalTo(t *testing.T) {
+	doc := parseXML(t, `<catalog xmlns:p="urn:p">
+		<book id="b1" stock="2"><title>Go</title><price>39.95</price><pages>320.7</pages>
+			<author>Alan</author><author>Brian</author>
+			<review p:by="x"><rating>4</rating></review><review p:by="y"><rating>5</rating></review>
+		</book>
+		<book id="b2" stock="0"><title>XPath</title><price>abc</price><pages>-5</pages></book>
+	</catalog>`)
+	type Review struct {
+		By     string `xpath:"@p:by"`
+		Rating int    `xpath:"rating"`
+	}
+	type Book struct {
+		ID      string   `xpath:"@id"`
+		Title   string   `xpath:"title"`
+		Price   float64  `xpath:"price"`
+		Cents   int      `xpath:"price * 100"`
+		Pages   uint16   `xpath:"pages"`
+		InStock bool     `xpath:"@stock > 0"`
+		Authors []string `xpath:"author"`
+		Reviews []Review `xpath:"review"`
+		First   Review   `xpath:"review[1]"`
+		Ignored string
+		private string `xpath:"@id"`
+	}
+	compiler := &Compiler{Namespaces: map[string]string{"p": "urn:p"}}
+	x, err := compiler.Compile("/catalog/book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var books []Book
+	if err := x.EvalTo(doc, nil, &books); err != nil {
+		t.Fatal(err)
+	}
+	actual := fmt.Sprintf("%+v", books)
+	expected := "[{ID:b1 Title:Go Price:39.95 Cents:3995 Pages:320 InStock:true Authors:[Alan Brian] Reviews:[{By:x Rating:4} {By:y Rating:5}] First:{By:x Rating:4} Ignored: private:} " +
+		"{ID:b2 Title:XPath Price:NaN Cents:0 Pages:0 InStock:false Authors:[] Reviews:[] First:{By: Rating:0} Ignored: private:}]"
+	if actual != expected {
+		t.Errorf("FAIL: EvalTo\nexpected: %s\nactual: %s", expected, actual)
+	}
+
+	var book Book
+	if err := x.EvalTo(doc, nil, &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.ID != "b1" || len(book.Reviews) != 2 {
+		t.Errorf("FAIL: EvalTo struct: %+v", book)
+	}
+	if len(x.tags.cache) != 2 {
+		t.Errorf("FAIL: expected xpaths of 2 struct types cached, but got %d", len(x.tags.cache))
+	}
+	cached := x.tags.cache[reflect.TypeOf(book)][0]
+	if err := x.EvalTo(doc, nil, &book); err != nil {
+		t.Fatal(err)
+	}
+	if x.tags.cache[reflect.TypeOf(book)][0] != cached {
+		t.Errorf("FAIL: EvalTo must reuse the cached xpaths")
+	}
+
+	x, err = compiler.Compile("/catalog/book[@id = $id]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	book = Book{ID: "none"}
+	if err := x.EvalTo(doc, VariableMap{"id": "b3"}, &book); err != nil {
+		t.Fatal(err)
+	}
+	if book.ID != "none" {
+		t.Errorf("FAIL: EvalTo modified struct for empty node-set: %+v", book)
+	}
+
+	errTests := []struct {
+		xpath string
+		out   interface{}
+		err   string
+	}{
+		{"/catalog/book", books, "cannot store nodes in []xpath.Book"},
+		{"/catalog/book", (*Book)(nil), "cannot store nodes in *xpath.Book"},
+		{"/catalog/book", &[]string{}, "cannot store nodes in *[]string"},
+		{"/catalog/book", &struct {
+			Prices []float64 `xpath:"price"`
+		}{}, "field Prices has unsupported type []float64"},
+		{"/catalog/book", &struct {
+			Title map[string]string `xpath:"title"`
+		}{}, "field Title has unsupported type map[string]string"},
+		{"/catalog/book", &struct {
+			Title string `xpath:"q:title"`
+		}{}, "unresolved prefix: q"},
+		{"count(/catalog/book)", &Book{}, "number cannot be converted to node-set"},
+	}
+	for _, test := range errTests {
+		x, err := compiler.Compile(test.xpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = x.EvalTo(doc, nil, test.out)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("FAIL: EvalTo(%T)\nexpected: %s\nactual: %v", test.out, test.err, err)
+		}
+	}
+}
+
+func TestEvalToOptions(t *testing.T) {
+	doc := parseXML(t, "<a>\n  <b k=\"x\">1</b>\n  <b k=\"y\">2</b>\n</a>")
+	type A struct {
+		Nodes []string `xpath:"node()"`
+		HasX  bool     `xpath:"b/@k = 'X'"`
+	}
+	compiler := &Compiler{StripWhitespace: true, Collation: CaseInsensitive}
+	x, err := compiler.Compile("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a A
+	if err := x.EvalTo(doc, nil, &a); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(a.Nodes, ",") != "1,2" {
+		t.Errorf("whitespace must be stripped, but got %q", a.Nodes)
+	}
+	if !a.HasX {
+		t.Error("collation must be used")
+	}
+}
+
+func TestDetectMutation(t *testing.T) {
+	tests := []struct {
+		xpath string
+		err   string
+	}{
+		{`count(/a/b[position() = 1 and mutate(.)])`, "document modified during evaluation at /a[1]/b[1]"},
+		{`count(/a/*[mutate(/a/c)])`, "document modified during evaluation at /a[1]/c[1]"},
+		{`count(//*[mutate(.)])`, "document modified during evaluation at "},
+		{`boolean(/a/c/@*[mutate(..)])`, "document modified during evaluation at /a[1]/c[1]"},
+		{`count(/a/b)`, ""},
+	}
+	for _, detect := range []bool{false, true} {
+		for _, test := range tests {
+			doc := parseXML(t, `<a><b/><b/><c x="1"/></a>`)
+			compiler := &Compiler{
+				DetectMutation: detect,
+				Functions: FunctionMap{
+					"mutate": {Boolean, Args{Mandatory(NodeSet)}, CompileFunc(func(args []interface{}) interface{} {
+						for _, n := range args[0].([]dom.Node) {
+							elem := n.(*dom.Element)
+							if err := elem.Append(&dom.Element{Name: &dom.Name{Local: "new"}}); err != nil {
+								t.Fatal(err)
+							}
+							elem.Attrs = append(elem.Attrs, &dom.Attr{Owner: elem, Name: &dom.Name{Local: "new"}})
+						}
+						return true
+					})},
+				},
+			}
+			expr, err := compiler.Compile(test.xpath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = expr.Eval(doc, nil)
+			if !detect || test.err == "" {
+				if err != nil {
+					t.Errorf("FAIL: %s with DetectMutation=%v: %v", test.xpath, detect, err)
+				}
+			} else if _, ok := err.(ConcurrentModificationError); !ok || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("FAIL: %s\nexpected: %s\nactual: %v", test.xpath, test.err, err)
+			}
+		}
+	}
+
+	// the modified node may be removed from document
+	detached := &dom.Element{Name: &dom.Name{Local: "b"}}
+	err := ConcurrentModificationError{Node: detached, Path: "/a[1]/b[1]"}
+	if err.Error() != "document modified during evaluation at /a[1]/b[1]" {
+		t.Errorf("FAIL: unexpected error message %q", err.Error())
+	}
+	if err := (ConcurrentModificationError{Node: detached}).Error(); err == "" {
+		t.Errorf("FAIL: expected error message")
+	}
+}
+
+func TestRootFunc(t *testing.T) {
+	doc := parseXML(t, `<a><b id="1"><c/></b><b id="2"/></a>`)
+	b := doc.RootElement().Children()[0].(*dom.Element)
+	detached := &dom.Element{Name: &dom.Name{Local: "x"}}
+	for _, child := range b.Children() {
+		if err := detached.Append(child); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attr := &dom.Attr{Owner: detached, Name: &dom.Name{Local: "id"}, Value: "d"}
+	detached.Attrs = append(detached.Attrs, attr)
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	tests := []struct {
+		ctx    *Context
+		xpath  string
+		result string
+	}{
+		{&Context{Node: doc}, `ext:kind(ext:root())`, "document"},
+		{&Context{Node: b}, `ext:kind(ext:root())`, "document"},
+		{&Context{Node: b}, `ext:kind(ext:root(@id))`, "document"},
+		{&Context{Node: b, Root: b}, `string(ext:root()/@id)`, "1"},
+		{&Context{Node: b, Root: b}, `ext:kind(ext:root(.))`, "document"},
+		{&Context{Node: detached}, `name(ext:root())`, "x"},
+		{&Context{Node: detached}, `name(ext:root(c))`, "x"},
+		{&Context{Node: detached}, `name(ext:root(@id))`, "x"},
+		{&Context{Node: detached}, `string(ext:root(c)/@id)`, "d"},
+		{&Context{Node: attr}, `name(ext:root())`, "x"},
+		{&Context{Node: detached}, `count(ext:root(c) | .)`, "1"},
+	}
+	for _, test := range tests {
+		expr, err := compiler.Compile(test.xpath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := expr.EvalIn(test.ctx)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if actual := Value2String(r); actual != test.result {
+			t.Errorf("FAIL: xpath: %s\nexpected: %s\nactual: %s", test.xpath, test.result, actual)
+		}
+	}
+}
+
+func TestCompileStreaming(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<catalog xmlns="urn:c" xmlns:p="urn:p">
+  <book id="1" p:lang="en"><title>Go</title><price>10</price></book>
+  <book id="2"><title>XPath</title><!-- note --><book id="3"><title>Nested</title></book></book>
+  <p:book id="4"><title>Other<![CDATA[ & more]]></title></p:book>
+  <shelf><book id="5" deleted="true"><title>Old</title></book></shelf>
+</catalog>`
+	compiler := &Compiler{Namespaces: map[string]string{"c": "urn:c", "p": "urn:p", "ext": ExtensionNS}}
+	tests := []struct {
+		xpath  string
+		result []string
+	}{
+		{`/c:catalog/c:book`, []string{"1 Go10", "2 XPathNested"}},
+		{`//c:book[string-length(normalize-space(@id)) = 1 and number(@id) mod 2 = 0]`, []string{"2 XPathNested"}},
+		{`//*[starts-with(concat(@id, name()), '4')]`, []string{"4 Other & more"}},
+		{`//c:book`, []string{"1 Go10", "3 Nested", "2 XPathNested", "5 Old"}},
+		{`/descendant::c:book`, []string{"1 Go10", "3 Nested", "2 XPathNested", "5 Old"}},
+		{`//c:book/c:book`, []string{"3 Nested"}},
+		{`//c:book//c:title`, []string{" Go", " XPath", " Nested", " Old"}},
+		{`/c:catalog/*/c:title`, []string{" Go", " XPath", " Other & more"}},
+		{`/c:catalog/p:*`, []string{"4 Other & more"}},
+		{`//*[@id > 2 and not(@deleted)]`, []string{"3 Nested", "4 Other & more"}},
+		{`//c:book[@p:lang = 'en']`, []string{"1 Go10"}},
+		{`//*[local-name() = 'book'][@id != 2]`, []string{"1 Go10", "3 Nested", "4 Other & more", "5 Old"}},
+		{`/c:catalog/c:shelf//c:title`, []string{" Old"}},
+		{`/c:book`, nil},
+		{`/*/*/*/*`, []string{" Nested", " Old"}},
+	}
+	for _, test := range tests {
+		x, err := compiler.CompileStreaming(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		var result []string
+		err = x.Each(strings.NewReader(doc), func(elem *dom.Element) bool {
+			var id string
+			if attr := elem.GetAttr("", "id"); attr != nil {
+				id = attr.Value
+			}
+			result = append(result, id+" "+Node2String(elem))
+			return true
+		})
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if fmt.Sprint(result) != fmt.Sprint(test.result) {
+			t.Errorf("FAIL: xpath: %s\nexpected: %q\nactual: %q", test.xpath, test.result, result)
+		}
+	}
+
+	// matched element is detached, but keeps in-scope namespaces
+	x, err := compiler.CompileStreaming(`//c:title`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = x.Each(strings.NewReader(doc), func(elem *dom.Element) bool {
+		count++
+		if elem.Parent() != nil {
+			t.Errorf("FAIL: matched element is not detached")
+		}
+		if uri, _ := elem.ResolvePrefix("p"); uri != "urn:p" {
+			t.Errorf("FAIL: prefix p resolved to %q", uri)
+		}
+		return count < 2
+	})
+	if err != nil || count != 2 {
+		t.Errorf("FAIL: Each must stop when fn returns false: count=%d err=%v", count, err)
+	}
+
+	errTests := []string{
+		`count(//c:book)`,
+		`c:catalog`,
+		`/`,
+		`/c:catalog/..`,
+		`//c:book/@id`,
+		`//c:book/text()`,
+		`//c:book/following-sibling::c:book`,
+		`//c:book[2]`,
+		`//c:book[last()]`,
+		`//c:book[c:title]`,
+		`//c:book[. = 'x']`,
+		`//c:book[string-length() > 2]`,
+		`//c:book[@id = $id]`,
+		`//c:book[../@id]`,
+		`//c:book[@id][@*[1]]`,
+		`//c:book[ext:word-count() = 2]`,
+		`//c:book[ext:node-path(@id) != '']`,
+		`//c:book[number() > 2]`,
+		`//c:book[lang('en')]`,
+		`//c:book[id('1')]`,
+	}
+	for _, str := range errTests {
+		_, err := compiler.CompileStreaming(str)
+		if _, ok := err.(StreamingError); !ok {
+			t.Errorf("FAIL: %s: expected StreamingError, but got %v", str, err)
+		}
+	}
+	if _, err := compiler.CompileStreaming(`//q:book`); err != UnresolvedPrefixError("q") {
+		t.Errorf("FAIL: expected UnresolvedPrefixError, but got %v", err)
+	}
+
+	x, err = compiler.CompileStreaming(`//c:book`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range []string{`<a xmlns="urn:c"><book>`, `<a><b></a>`, `<q:a/>`} {
+		if err := x.Each(strings.NewReader(doc), func(*dom.Element) bool { return true }); err == nil {
+			t.Errorf("FAIL: %s: expected error", doc)
+		}
+	}
+}
+
+func TestMaxRangeSize(t *testing.T) {
+	tests := []struct {
+		xpath string
+		max   int
+		err   bool
+	}{
+		{`count(ext:range(1, 10000))`, 0, false},
+		{`count(ext:range(1, 10001))`, 0, true},
+		{`count(ext:range(1, 1 div 0))`, 0, true},
+		{`count(ext:range(-1 div 0, 1))`, 0, true},
+		{`count(ext:range(1 div 0, 1 div 0))`, 0, true},
+		{`count(ext:range(-1 div 0, -1 div 0))`, 0, true},
+		{`count(ext:range(1, 5))`, 5, false},
+		{`count(ext:range(1, 6))`, 5, true},
+		{`count(ext:range(6, 1))`, 5, false},
+	}
+	for _, test := range tests {
+		compiler := &Compiler{
+			Namespaces:   map[string]string{"ext": ExtensionNS},
+			MaxRangeSize: test.max,
+		}
+		expr, err := compiler.Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		_, err = expr.Eval(nil, nil)
+		max := test.max
+		if max == 0 {
+			max = 10000
+		}
+		if test.err {
+			if err != RangeSizeError(max) {
+				t.Errorf("FAIL: %s with limit %d: expected RangeSizeError, but got %v", test.xpath, test.max, err)
+			}
+		} else if err != nil {
+			t.Errorf("FAIL: %s with limit %d: %v", test.xpath, test.max, err)
+		}
+	}
+}
+
+func TestMaxPaddingLength(t *testing.T) {
+	tests := []struct {
+		length float64
+		max    int
+		err    bool
+	}{
+		{1048576, 0, false},
+		{1048577, 0, true},
+		{math.Inf(+1), 0, true},
+		{5, 5, false},
+		{5.9, 5, false},
+		{6, 5, true},
+	}
+	for _, test := range tests {
+		compiler := &Compiler{
+			Namespaces:       map[string]string{"str": EXSLTStrings},
+			MaxPaddingLength: test.max,
+		}
+		expr, err := compiler.Compile(`string-length(str:padding($n, 'ab'))`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = expr.Eval(nil, VariableMap{"n": test.length})
+		max := test.max
+		if max == 0 {
+			max = 1048576
+		}
+		if test.err {
+			if err != PaddingLengthError(max) {
+				t.Errorf("FAIL: length %v with limit %d: expected PaddingLengthError, but got %v", test.length, test.max, err)
+			}
+		} else if err != nil {
+			t.Errorf("FAIL: length %v with limit %d: %v", test.length, test.max, err)
+		}
+	}
+	compiler := &Compiler{
+		Namespaces:       map[string]string{"str": EXSLTStrings},
+		MaxPaddingLength: 5,
+	}
+	if _, err := compiler.Compile(`str:padding(6)`); err != PaddingLengthError(5) {
+		t.Errorf("expected PaddingLengthError, but got %v", err)
+	}
+}
+
+func TestBooleanStrings(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>2</b></a>`)
+	tests := []struct {
+		bools  [2]string
+		xpath  string
+		result string
+	}{
+		{[2]string{}, `string(true())`, "true"},
+		{[2]string{}, `/a/b = 2`, "true"},
+		{[2]string{"0", "1"}, `string(true())`, "1"},
+		{[2]string{"0", "1"}, `string(false())`, "0"},
+		{[2]string{"0", "1"}, `/a/b = 2`, "1"},
+		{[2]string{"0", "1"}, `/a/b = 3`, "0"},
+		{[2]string{"0", "1"}, `concat(/a/b[1] = 1, '-', /a/b[2] = 1)`, "1-0"},
+		{[2]string{"0", "1"}, `string($t)`, "1"},
+		{[2]string{"0", "1"}, `string-length(true())`, "1"},
+		{[2]string{"0", "1"}, `string(/a/b[1])`, "1"},
+		{[2]string{"0", "1"}, `string(1 = 1) = 'true'`, "0"},
+		{[2]string{"0", "1"}, `true() = 'false'`, "1"},
+		{[2]string{"0", "1"}, `number(true())`, "1"},
+		{[2]string{"nein", "ja"}, `translate(boolean(/a/c), 'n', 'N')`, "NeiN"},
+		{[2]string{"nein", "ja"}, `dyn(/a/b = 1)`, "ja"},
+	}
+	for _, test := range tests {
+		compiler := &Compiler{
+			BooleanStrings: test.bools,
+			DynamicFunctions: FunctionMap{
+				"dyn": {String, Args{Mandatory(String)}, CompileFunc(func(args []interface{}) interface{} {
+					return args[0]
+				})},
+			},
+		}
+		expr, err := compiler.Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		actual, err := expr.EvalString(doc, VariableMap{"t": true})
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if actual != test.result {
+			t.Errorf("FAIL: xpath: %s with %q\nexpected: %s\nactual: %s", test.xpath, test.bools, test.result, actual)
+		}
+	}
+
+	// boolean literals are folded using the configured strings
+	compiler := &Compiler{BooleanStrings: [2]string{"0", "1"}}
+	for xpath, expected := range map[string]string{
+		`string(true())`:       "1",
+		`concat('a', false())`: "a0",
+		`string(1 = 1)`:        "1",
+	} {
+		expr, err := compiler.Compile(xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", xpath, err)
+			continue
+		}
+		if !expr.IsStatic() {
+			t.Errorf("FAIL: %s: must be static", xpath)
+		}
+		if actual, err := expr.EvalString(nil, nil); err != nil || actual != expected {
+			t.Errorf("FAIL: %s: expected %s, but got %s, %v", xpath, expected, actual, err)
+		}
+	}
+}
+
+func TestStrictFunctions(t *testing.T) {
+	doc := parseXML(t, `<a><b>1</b><b>x</b></a>`)
+	// parse returns float64 for numbers, but string otherwise
+	parse := func(args []interface{}) interface{} {
+		s := args[0].(string)
+		if f := String2Number(s); !math.IsNaN(f) {
+			return f
+		}
+		return s
+	}
+	functions := FunctionMap{
+		"parse":     {Args: Args{Mandatory(String)}, Compile: CompileTypedFunc(Number, parse)},
+		"parseAny":  {Args: Args{Mandatory(String)}, Compile: CompileTypedFunc(Any, parse)},
+		"parseDecl": {Number, Args{Mandatory(String)}, CompileFunc(parse)},
+	}
+	tests := []struct {
+		xpath      string
+		compileErr error
+		evalErr    error
+		result     string
+	}{
+		{`parse(/a/b[1]) + 1`, nil, nil, "2"},
+		{`parse('2')`, nil, nil, "2"},
+		{`parse(/a/b[2])`, nil, ReturnTypeError{"parse", Number, String}, ""},
+		{`parse('x')`, ReturnTypeError{"parse", Number, String}, nil, ""},
+		{`parseDecl(/a/b[2])`, nil, ReturnTypeError{"parseDecl", Number, String}, ""},
+		{`parseAny(/a/b[2])`, nil, nil, "x"},
+		{`dyn(/a/b[1])`, nil, nil, "1"},
+		{`dyn(/a/b[2])`, nil, ReturnTypeError{"dyn", Number, String}, ""},
+		{`concat(parse(/a/b[2]), '')`, nil, ReturnTypeError{"parse", Number, String}, ""},
+	}
+	for _, strict := range []bool{false, true} {
+		compiler := &Compiler{
+			Functions:        functions,
+			DynamicFunctions: FunctionMap{"dyn": functions["parse"]},
+			StrictFunctions:  strict,
+		}
+		for _, test := range tests {
+			if !strict && (test.compileErr != nil || test.evalErr != nil) {
+				continue
+			}
+			expr, err := compiler.Compile(test.xpath)
+			if err != test.compileErr {
+				t.Errorf("FAIL: compile %s: expected %v, but got %v", test.xpath, test.compileErr, err)
+				continue
+			}
+			if err != nil {
+				continue
+			}
+			r, err := expr.Eval(doc, nil)
+			if err != test.evalErr {
+				t.Errorf("FAIL: eval %s: expected %v, but got %v", test.xpath, test.evalErr, err)
+				continue
+			}
+			if err == nil && Value2String(r) != test.result {
+				t.Errorf("FAIL: xpath: %s\nexpected: %s\nactual: %s", test.xpath, test.result, Value2String(r))
+			}
+		}
+	}
+
+	// without strict mode, mismatched value is returned as is
+	expr, err := (&Compiler{Functions: functions}).Compile(`parse(/a/b[2])`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := expr.Eval(doc, nil); err != nil || r != "x" || expr.Returns() != Number {
+		t.Errorf("FAIL: non-strict parse: %v %v %v", r, err, expr.Returns())
+	}
+}
+
+func TestEvalForEach(t *testing.T) {
+	doc := parseXML(t, `<orders>
+		<order id="1"><item qty="2" price="10"/><item qty="1" price="5"/></order>
+		<order id="2"><item qty="3" price="1.5"/></order>
+		<order id="3"/>
+	</orders>`)
+	compiler := &Compiler{}
+	rows, err := compiler.Compile("/orders/order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := rows.EvalNodeSet(doc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total, err := compiler.Compile("concat(position(), '/', last(), ' ', @id, '=', sum(item/@qty) * $tax)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	err = total.EvalForEach(nodes, VariableMap{"tax": float64(2)}, func(n dom.Node, r interface{}) error {
+		if n.(*dom.Element).GetAttr("", "id") == nil {
+			t.Errorf("FAIL: fn called with wrong node %v", n)
+		}
+		result = append(result, r.(string))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[1/3 1=6 2/3 2=6 3/3 3=0]"
+	if actual := fmt.Sprint(result); actual != expected {
+		t.Errorf("FAIL: EvalForEach\nexpected: %s\nactual: %s", expected, actual)
+	}
+
+	// error from fn stops iteration
+	stop := errors.New("stop")
+	count := 0
+	err = total.EvalForEach(nodes, VariableMap{"tax": float64(1)}, func(dom.Node, interface{}) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("FAIL: EvalForEach must stop on error: count=%d err=%v", count, err)
+	}
+
+	// evaluation error is returned
+	err = total.EvalForEach(nodes, nil, func(dom.Node, interface{}) error {
+		t.Error("FAIL: fn must not be called")
+		return nil
+	})
+	if _, ok := err.(UnresolvedVariableError); !ok {
+		t.Errorf("FAIL: expected UnresolvedVariableError, but got %v", err)
+	}
+
+	// budget is per node
+	compiler.MaxNodesVisited = 3
+	items, err := compiler.Compile("count(item)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts []float64
+	err = items.EvalForEach(nodes, nil, func(n dom.Node, r interface{}) error {
+		counts = append(counts, r.(float64))
+		return nil
+	})
+	if err != nil || fmt.Sprint(counts) != "[2 1 0]" {
+		t.Errorf("FAIL: EvalForEach with budget: %v %v", counts, err)
+	}
+}
+
+func TestWithDocumentNamespaces(t *testing.T) {
+	doc := parseXML(t, `<a:root xmlns="urn:default" xmlns:a="urn:a" xmlns:b="urn:b">
+		<a:x>1</a:x><b:x>2</b:x><x>3</x><c:x xmlns:c="urn:c">4</c:x>
+	</a:root>`)
+	base := &Compiler{Namespaces: map[string]string{"b": "urn:a", "d": "urn:default"}}
+	compiler := base.WithDocumentNamespaces(doc)
+	if len(base.Namespaces) != 2 {
+		t.Errorf("FAIL: WithDocumentNamespaces modified the compiler: %v", base.Namespaces)
+	}
+	tests := []struct {
+		xpath  string
+		result string
+	}{
+		{`string(/a:root/a:x)`, "1"},
+		{`count(/a:root/b:x)`, "1"},
+		{`string(/a:root/b:x)`, "1"},
+		{`string(/a:root/d:x)`, "3"},
+		{`count(/a:root/x)`, "0"},
+		{`count(//@xml:lang)`, "0"},
+	}
+	for _, test := range tests {
+		expr, err := compiler.Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		actual, err := expr.EvalString(doc, nil)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		if actual != test.result {
+			t.Errorf("FAIL: xpath: %s\nexpected: %s\nactual: %s", test.xpath, test.result, actual)
+		}
+	}
+	if _, err := compiler.Compile(`/a:root/c:x`); err != UnresolvedPrefixError("c") {
+		t.Errorf("FAIL: prefix declared below root must not be imported: %v", err)
+	}
+	compiler = (&Compiler{}).WithDocumentNamespaces(&dom.Document{})
+	if len(compiler.Namespaces) != 0 {
+		t.Errorf("FAIL: empty document: %v", compiler.Namespaces)
+	}
+}
+
+func TestAncestorNamedErrors(t *testing.T) {
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	tests := map[string]error{
+		`ext:ancestor-named(name())`:      LiteralArgError(ClarkName(ExtensionNS, "ancestor-named")),
+		`ext:ancestor-named('x:section')`: UnresolvedPrefixError("x"),
+	}
+	for xpath, expected := range tests {
+		if _, err := compiler.Compile(xpath); err != expected {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", xpath, expected, err)
+		}
+	}
+}
+
+func TestEvalBooleanStrict(t *testing.T) {
+	doc := parseXML(t, `<a><b x="">0</b><b/></a>`)
+	tests := []struct {
+		xpath  string
+		result bool
+		err    error
+	}{
+		{`/a/b[1]/@x`, true, nil},
+		{`/a/b[2]/@x`, false, nil},
+		{`/a/b[1]/text()`, true, nil},
+		{`/a/b[2]/text()`, false, nil},
+		{`//nothing`, false, nil},
+		{`string(/a/b[1]/@x)`, false, ConversionError{String, NodeSet}},
+		{`string(/a/b[2]/@x)`, false, ConversionError{String, NodeSet}},
+		{`string(/a/b[1])`, true, ConversionError{String, NodeSet}},
+		{`number(/a/b[1])`, false, ConversionError{Number, NodeSet}},
+		{`count(/a/b)`, true, ConversionError{Number, NodeSet}},
+		{`/a/b[1]/@x = ''`, true, ConversionError{Boolean, NodeSet}},
+		{`$v`, true, nil},
+		{`$s`, false, ConversionError{String, NodeSet}},
+	}
+	vars := VariableMap{
+		"v": []dom.Node{doc},
+		"s": "",
+	}
+	for _, test := range tests {
+		expr, err := new(Compiler).Compile(test.xpath)
+		if err != nil {
+			t.Errorf("FAIL: %s: %v", test.xpath, err)
+			continue
+		}
+		actual, err := expr.EvalBooleanStrict(doc, vars)
+		if err != test.err {
+			t.Errorf("FAIL: %s: expected error %v, but got %v", test.xpath, test.err, err)
+		}
+		if actual != test.result {
+			t.Errorf("FAIL: xpath: %s expected: %v actual: %v", test.xpath, test.result, actual)
+		}
+		if test.err == nil {
+			if b, _ := expr.EvalBoolean(doc, vars); b != actual {
+				t.Errorf("FAIL: %s: EvalBoolean gave %v", test.xpath, b)
+			}
+		}
+	}
+}
+
+func TestNoSimplify(t *testing.T) {
+	tests := map[string]string{
+		`1 + 2`:                 "3",
+		`concat('a', 'b', 1)`:   "ab1",
+		`true() and 1 > 2`:      "false",
+		`not(1 = 2) or false()`: "true",
+	}
+	for xpath, expected := range tests {
+		for _, noSimplify := range []bool{false, true} {
+			expr, err := (&Compiler{NoSimplify: noSimplify}).Compile(xpath)
+			if err != nil {
+				t.Errorf("FAIL: %s: %v", xpath, err)
+				continue
+			}
+			if expr.IsStatic() == noSimplify {
+				t.Errorf("FAIL: %s noSimplify=%v: IsStatic is %v", xpath, noSimplify, expr.IsStatic())
+			}
+			if actual, err := expr.EvalString(nil, nil); err != nil || actual != expected {
+				t.Errorf("FAIL: %s noSimplify=%v: expected %s, but got %s, %v", xpath, noSimplify, expected, actual, err)
+			}
+		}
+	}
+
+	expr, err := (&Compiler{StrictNumeric: true, NoSimplify: true}).Compile(`0 div 0`)
+	if err != nil {
+		t.Fatalf("FAIL: 0 div 0: %v", err)
+	}
+	if _, err := expr.Eval(nil, nil); err != DivideByZeroError("div") {
+		t.Errorf("FAIL: 0 div 0: expected DivideByZeroError, but got %v", err)
+	}
+
+	// key expression of ext:sort is not simplified either
+	doc := parseXML(t, `<a><b/><b/></a>`)
+	compiler := &Compiler{
+		Namespaces:    map[string]string{"ext": ExtensionNS},
+		StrictNumeric: true,
+	}
+	if _, err := compiler.Compile(`ext:sort(//b, '0 div 0')`); err != DivideByZeroError("div") {
+		t.Errorf("FAIL: sort key: expected DivideByZeroError, but got %v", err)
+	}
+	compiler.NoSimplify = true
+	expr, err = compiler.Compile(`ext:sort(//b, '0 div 0')`)
+	if err != nil {
+		t.Fatalf("FAIL: sort key: %v", err)
+	}
+	if _, err := expr.Eval(doc, nil); err != DivideByZeroError("div") {
+		t.Errorf("FAIL: sort key: expected DivideByZeroError, but got %v", err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	tests := []struct {
+		xpath string
+		depth int
+	}{
+		{`1`, 1},
+		{`((1))`, 2},
+		{`/a/b/c`, 1},
+		{`1 + 2`, 2},
+		{`-1`, 2},
+		{`1 + 2 * 3`, 3},
+		{`-(-(1))`, 3},
+		{`a[b]`, 2},
+		{`a[b[c]]`, 3},
+		{`a[1]/b[c[d]]`, 3},
+		{`string(string(1))`, 3},
+		{`(a)[1]`, 2},
+		{`(a)/b[c]`, 3},
+	}
+	for _, test := range tests {
+		if _, err := (&Compiler{MaxDepth: test.depth}).Compile(test.xpath); err != nil {
+			t.Errorf("FAIL: %s MaxDepth=%d: %v", test.xpath, test.depth, err)
+		}
+		_, err := (&Compiler{MaxDepth: test.depth - 1}).Compile(test.xpath)
+		if test.depth == 1 {
+			// MaxDepth 0 means no limit
+			if err != nil {
+				t.Errorf("FAIL: %s MaxDepth=0: %v", test.xpath, err)
+			}
+		} else if err != TooDeepError(test.depth-1) {
+			t.Errorf("FAIL: %s MaxDepth=%d: expected TooDeepError, but got %v", test.xpath, test.depth-1, err)
+		}
+	}
+
+	xpath := strings.Repeat("-(", 500) + "1" + strings.Repeat(")", 500)
+	if _, err := new(Compiler).Compile(xpath); err != nil {
+		t.Errorf("FAIL: without MaxDepth: %v", err)
+	}
+	if _, err := (&Compiler{MaxDepth: 100}).Compile(xpath); err != TooDeepError(100) {
+		t.Errorf("FAIL: expected TooDeepError, but got %v", err)
+	}
+
+	// rejected before parsing
+	xpath = strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000)
+	if _, err := (&Compiler{MaxDepth: 100}).Compile(xpath); err != TooDeepError(100) {
+		t.Errorf("FAIL: expected TooDeepError, but got %v", err)
+	}
+	if _, err := (&Compiler{MaxDepth: 2}).Compile(`concat('((((', "[[[[")`); err != nil {
+		t.Errorf("FAIL: brackets in literals: %v", err)
+	}
+
+	// sort key is nested within the function call
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}}
+	for _, test := range []struct {
+		xpath string
+		depth int
+	}{
+		{`ext:sort(//a, '@k')`, 2},
+		{`ext:sort(//a, 'string(@k)')`, 3},
+		{`ext:sort(//a, '((@k))')`, 3},
+		{`count(ext:sort(//a, 'string(@k)'))`, 4},
+	} {
+		compiler.MaxDepth = test.depth
+		if _, err := compiler.Compile(test.xpath); err != nil {
+			t.Errorf("FAIL: %s MaxDepth=%d: %v", test.xpath, test.depth, err)
+		}
+		compiler.MaxDepth = test.depth - 1
+		if _, err := compiler.Compile(test.xpath); err != TooDeepError(test.depth-1) {
+			t.Errorf("FAIL: %s MaxDepth=%d: expected TooDeepError, but got %v", test.xpath, test.depth-1, err)
+		}
+	}
+}
+
+func TestTryValue2(t *testing.T) {
+	doc := parseXML(t, `<a>12</a>`)
+	tests := []struct {
+		v      interface{}
+		str    string
+		num    float64
+		result bool
+	}{
+		{[]dom.Node{doc}, "12", 12, true},
+		{[]dom.Node(nil), "", math.NaN(), false},
+		{"x", "x", math.NaN(), true},
+		{"", "", math.NaN(), false},
+		{1.5, "1.5", 1.5, true},
+		{math.NaN(), "NaN", math.NaN(), false},
+		{true, "true", 1, true},
+		{false, "false", 0, false},
+	}
+	for _, test := range tests {
+		if s, err := TryValue2String(test.v); err != nil || s != test.str {
+			t.Errorf("FAIL: TryValue2String(%#v): expected %q, but got %q, %v", test.v, test.str, s, err)
+		}
+		if n, err := TryValue2Number(test.v); err != nil || !(n == test.num || math.IsNaN(n) && math.IsNaN(test.num)) {
+			t.Errorf("FAIL: TryValue2Number(%#v): expected %v, but got %v, %v", test.v, test.num, n, err)
+		}
+		if b, err := TryValue2Boolean(test.v); err != nil || b != test.result {
+			t.Errorf("FAIL: TryValue2Boolean(%#v): expected %v, but got %v, %v", test.v, test.result, b, err)
+		}
+	}
+
+	for _, v := range []interface{}{1, nil, []string{"x"}, float32(1), &dom.Text{Data: "x"}} {
+		expected := InvalidValueError{v}
+		if _, err := TryValue2String(v); !reflect.DeepEqual(err, expected) {
+			t.Errorf("FAIL: TryValue2String(%#v): expected %v, but got %v", v, expected, err)
+		}
+		if _, err := TryValue2Number(v); !reflect.DeepEqual(err, expected) {
+			t.Errorf("FAIL: TryValue2Number(%#v): expected %v, but got %v", v, expected, err)
+		}
+		if _, err := TryValue2Boolean(v); !reflect.DeepEqual(err, expected) {
+			t.Errorf("FAIL: TryValue2Boolean(%#v): expected %v, but got %v", v, expected, err)
+		}
+	}
+}
+
+func TestSequenceDetectMutation(t *testing.T) {
+	compiler := &Compiler{Namespaces: map[string]string{"ext": ExtensionNS}, DetectMutation: true}
+	expr, err := compiler.Compile(`count(ext:string-to-codepoints('ab')/.. | ext:string-to-codepoints('c'))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := expr.EvalNumber(parseXML(t, `<a/>`), nil); err != nil || r != 2 {
+		t.Errorf("FAIL: expected 2, but got %v, %v", r, err)
+	}
+}
+
+func TestDetachedDocument(t *testing.T) {
+	b := &dom.Element{Name: &dom.Name{Local: "b"}}
+	a := &dom.Element{Name: &dom.Name{Local: "a"}, ChildNodes: []dom.Node{b}}
+	b.ParentNode = a
+	if d := (&Context{Node: b}).Document(); d != nil {
+		t.Errorf("FAIL: Document of detached node: expected nil, but got %v", d)
+	}
+	expr, err := new(Compiler).Compile(`name(/)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := expr.EvalString(b, nil); err != nil || r != "a" {
+		t.Errorf("FAIL: name(/): expected a, but got %q, %v", r, err)
+	}
+}
+
+func TestCanonicalLazy(t *testing.T) {
+	expr, err := (&Compiler{Namespaces: map[string]string{"p": "urn:p"}}).Compile(`//p:a[@b]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expr.canonical != "" {
+		t.Errorf("FAIL: canonical form must be computed on first use")
+	}
+	expected := `/descendant-or-self::node()/child::{urn:p}a[attribute::b]`
+	if actual := expr.Canonical(); actual != expected {
+		t.Errorf("FAIL: expected %s, but got %s", expected, actual)
+	}
+
+	// options are not part of canonical form
+	x1, err := new(Compiler).Compile(`'a' = 'A'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x2, err := (&Compiler{Collation: CaseInsensitive}).Compile(`'a' = 'A'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, _ := x1.EvalBoolean(nil, nil)
+	b2, _ := x2.EvalBoolean(nil, nil)
+	if x1.Canonical() != x2.Canonical() || b1 == b2 {
+		t.Errorf("FAIL: Canonical: %s %s, results: %v %v", x1.Canonical(), x2.Canonical(), b1, b2)
+	}
+}
@@ -7,7 +7,10 @@ package xpath
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"runtime"
+
+	"github.com/santhosh-tekuri/dom"
 )
 
 // UnresolvedPrefixError is the error type returned by *Compiler.Compile function.
@@ -61,7 +64,120 @@ func (e ArgCountError) Error() string {
 	return fmt.Sprintf("wrong number of args to function %s", string(e))
 }
 
-// InvalidValueError is the error type returned by *XPath.Eval function.
+// LiteralArgError is the error type returned by *Compiler.Compile function.
+//
+// It tells that function with that clarkName requires literal argument,
+// because it is evaluated at compile time.
+type LiteralArgError string
+
+func (e LiteralArgError) Error() string {
+	return fmt.Sprintf("function %s requires literal argument", string(e))
+}
+
+// DivideByZeroError is the error type returned by *XPath.Eval function.
+//
+// It tells that the divisor of div or mod operator is zero, when
+// compiled with Compiler.StrictNumeric.
+type DivideByZeroError string
+
+func (e DivideByZeroError) Error() string {
+	return fmt.Sprintf("division by zero in %s operator", string(e))
+}
+
+// ConcurrentModificationError is the error type returned by *XPath.Eval function.
+//
+// It tells that the document is modified during evaluation, when
+// compiled with Compiler.DetectMutation.
+type ConcurrentModificationError struct {
+	// Node is a node, whose children or attributes are changed
+	Node dom.Node
+
+	// Path is the NodePath of Node, when the modification is detected
+	Path string
+}
+
+func (e ConcurrentModificationError) Error() string {
+	return fmt.Sprintf("document modified during evaluation at %s", e.Path)
+}
+
+// RangeSizeError is the error type returned by *XPath.Eval function.
+//
+// It tells that the extension function range would return more nodes
+// than Compiler.MaxRangeSize, the expression was compiled with.
+type RangeSizeError int
+
+func (e RangeSizeError) Error() string {
+	return fmt.Sprintf("range has more than %d numbers", int(e))
+}
+
+// PaddingLengthError is the error type returned by *XPath.Eval function.
+//
+// It tells that the EXSLT function str:padding would return string
+// longer than Compiler.MaxPaddingLength, the expression was compiled with.
+type PaddingLengthError int
+
+func (e PaddingLengthError) Error() string {
+	return fmt.Sprintf("padding is longer than %d characters", int(e))
+}
+
+// ReturnTypeError is the error type returned by *XPath.Eval function.
+//
+// It tells that the user defined function returned value of type
+// other than it declared, when compiled with Compiler.StrictFunctions.
+type ReturnTypeError struct {
+	// Function is the clark-name of function
+	Function string
+
+	// Declared is the DataType, the function declared to return
+	Declared DataType
+
+	// Actual is the DataType of value returned
+	Actual DataType
+}
+
+func (e ReturnTypeError) Error() string {
+	return fmt.Sprintf("function %s returned %v, but declared to return %v", e.Function, e.Actual, e.Declared)
+}
+
+// StreamingError is the error type returned by *Compiler.CompileStreaming function.
+//
+// It tells that the xpath uses a construct, that is not supported
+// by streaming evaluation.
+type StreamingError string
+
+func (e StreamingError) Error() string {
+	return fmt.Sprintf("%s is not supported in streaming xpath", string(e))
+}
+
+// TooDeepError is the error type returned by *Compiler.Compile function.
+//
+// It tells that the expression is nested deeper than Compiler.MaxDepth.
+type TooDeepError int
+
+func (e TooDeepError) Error() string {
+	return fmt.Sprintf("expression is nested deeper than %d levels", int(e))
+}
+
+// DisallowedAxisError is the error type returned by *Compiler.Compile function.
+//
+// It tells that the axis is not in Compiler.AllowedAxes.
+type DisallowedAxisError string
+
+func (e DisallowedAxisError) Error() string {
+	return fmt.Sprintf("axis %s is not allowed", string(e))
+}
+
+// AttributeOrderError is the error type returned by *Compiler.Compile function.
+//
+// It tells that Compiler.AttributeOrder is not one of the supported values.
+type AttributeOrderError string
+
+func (e AttributeOrderError) Error() string {
+	return fmt.Sprintf("unsupported attribute order %q", string(e))
+}
+
+// InvalidValueError is the error type returned by *XPath.Eval function,
+// and TryValue2String, TryValue2Number and TryValue2Boolean functions.
 //
 // It tells that function registered returned value other than
 // []dom.Node, string, float64 or boolean
@@ -83,7 +199,55 @@ func (e VarMustBeNodeSet) Error() string {
 	return fmt.Sprintf("variable %s must evaluate to node-set", string(e))
 }
 
+// InvalidCodepointError is the error type returned by *XPath.Eval function.
+//
+// It tells that the number is not a valid unicode codepoint.
+type InvalidCodepointError float64
+
+func (e InvalidCodepointError) Error() string {
+	return fmt.Sprintf("%s is not a valid codepoint", Value2String(float64(e)))
+}
+
+// BudgetExceededError is the error type returned by *XPath.Eval function.
+//
+// It tells that the evaluation visited more nodes than the
+// Compiler.MaxNodesVisited, the expression was compiled with.
+type BudgetExceededError int
+
+func (e BudgetExceededError) Error() string {
+	return fmt.Sprintf("evaluation visited more than %d nodes", int(e))
+}
+
+// InvalidOutputError is the error type returned by *XPath.EvalTo function.
+//
+// It tells that the out argument is not a non-nil pointer to
+// a struct, or to a slice of structs.
+type InvalidOutputError struct {
+	Type reflect.Type
+}
+
+func (e InvalidOutputError) Error() string {
+	return fmt.Sprintf("cannot store nodes in %v", e.Type)
+}
+
+// UnsupportedFieldError is the error type returned by *XPath.EvalTo function.
+//
+// It tells that the struct field with xpath tag has a type,
+// that cannot be populated.
+type UnsupportedFieldError struct {
+	// Field is the name of struct field
+	Field string
+
+	// Type is the type of struct field
+	Type reflect.Type
+}
+
+func (e UnsupportedFieldError) Error() string {
+	return fmt.Sprintf("field %s has unsupported type %v", e.Field, e.Type)
+}
+
 // ConversionError is the error type returned by *XPath.EvalNodeSet
+// and *XPath.Eval
 //
 // It tells that the value of type Src cannot be converted to value of type Target
 type ConversionError struct {
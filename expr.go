@@ -108,9 +108,10 @@ func (e *arithmeticExpr) Simplify() Expr {
 /************************************************************************/
 
 type equalityExpr struct {
-	lhs   Expr
-	rhs   Expr
-	apply func(interface{}, interface{}) bool
+	lhs       Expr
+	rhs       Expr
+	apply     func(interface{}, interface{}) bool
+	collation Collation
 }
 
 func (*equalityExpr) Returns() DataType {
@@ -125,9 +126,9 @@ func (e *equalityExpr) Eval(ctx *Context) interface{} {
 		lhs, rhs := lhs.([]dom.Node), rhs.([]dom.Node)
 		if len(lhs) > 0 && len(rhs) > 0 {
 			for _, n1 := range lhs {
-				n1Str := Node2String(n1)
+				n1Str := ctx.node2String(n1)
 				for _, n2 := range rhs {
-					if e.apply(n1Str, Node2String(n2)) {
+					if e.applyStrings(n1Str, ctx.node2String(n2)) {
 						return true
 					}
 				}
@@ -141,7 +142,7 @@ func (e *equalityExpr) Eval(ctx *Context) interface{} {
 		case lhsType == Number || rhsType == Number:
 			return e.apply(Value2Number(lhs), Value2Number(rhs))
 		default:
-			return e.apply(Value2String(lhs), Value2String(rhs))
+			return e.applyStrings(Value2String(lhs), Value2String(rhs))
 		}
 	default:
 		var val interface{}
@@ -156,14 +157,14 @@ func (e *equalityExpr) Eval(ctx *Context) interface{} {
 			return e.apply(val, Value2Boolean(nodeSet))
 		case String:
 			for _, n := range nodeSet {
-				if e.apply(val, Node2String(n)) {
+				if e.applyStrings(val.(string), ctx.node2String(n)) {
 					return true
 				}
 			}
 			return false
 		default:
 			for _, n := range nodeSet {
-				if e.apply(val, Node2Number(n)) {
+				if e.apply(val, ctx.node2Number(n)) {
 					return true
 				}
 			}
@@ -172,6 +173,13 @@ func (e *equalityExpr) Eval(ctx *Context) interface{} {
 	}
 }
 
+func (e *equalityExpr) applyStrings(s1, s2 string) bool {
+	if e.collation != nil {
+		return e.apply(e.collation.Compare(s1, s2), 0)
+	}
+	return e.apply(s1, s2)
+}
+
 func (e *equalityExpr) Simplify() Expr {
 	e.lhs, e.rhs = Simplify(e.lhs), Simplify(e.rhs)
 	if Literals(e.lhs, e.rhs) {
@@ -200,9 +208,9 @@ func (e *relationalExpr) Eval(ctx *Context) interface{} {
 		lhs, rhs := lhs.([]dom.Node), rhs.([]dom.Node)
 		if len(lhs) > 0 && len(rhs) > 0 {
 			for _, n1 := range lhs {
-				if n1 := Node2Number(n1); !math.IsNaN(n1) {
+				if n1 := ctx.node2Number(n1); !math.IsNaN(n1) {
 					for _, n2 := range rhs {
-						if e.apply(n1, Node2Number(n2)) {
+						if e.apply(n1, ctx.node2Number(n2)) {
 							return true
 						}
 					}
@@ -215,7 +223,7 @@ func (e *relationalExpr) Eval(ctx *Context) interface{} {
 	case lhsType == NodeSet:
 		if rhs := Value2Number(rhs); !math.IsNaN(rhs) {
 			for _, n := range lhs.([]dom.Node) {
-				if e.apply(Node2Number(n), rhs) {
+				if e.apply(ctx.node2Number(n), rhs) {
 					return true
 				}
 			}
@@ -224,7 +232,7 @@ func (e *relationalExpr) Eval(ctx *Context) interface{} {
 	default:
 		if lhs := Value2Number(lhs); !math.IsNaN(lhs) {
 			for _, n := range rhs.([]dom.Node) {
-				if e.apply(lhs, Node2Number(n)) {
+				if e.apply(lhs, ctx.node2Number(n)) {
 					return true
 				}
 			}
@@ -293,9 +301,13 @@ func (*unionExpr) Returns() DataType {
 	return NodeSet
 }
 
+func (e *unionExpr) exists(ctx *Context) bool {
+	return exists(e.lhs, ctx) || exists(e.rhs, ctx)
+}
+
 func (e *unionExpr) Eval(ctx *Context) interface{} {
-	lhs := e.lhs.Eval(ctx).([]dom.Node)
-	rhs := e.rhs.Eval(ctx).([]dom.Node)
+	lhs := nodeSet(e.lhs.Eval(ctx))
+	rhs := nodeSet(e.rhs.Eval(ctx))
 	switch {
 	case len(lhs) == 0:
 		return rhs
@@ -311,22 +323,43 @@ func (e *unionExpr) Eval(ctx *Context) interface{} {
 				lhs = append(lhs, n)
 			}
 		}
-		order(lhs)
+		order(lhs, ctx)
 		return lhs
 	}
 }
 
 /************************************************************************/
 
+// existential is implemented by node-set expressions,
+// that can tell whether they select any node without
+// computing the whole node-set.
+type existential interface {
+	exists(ctx *Context) bool
+}
+
+// exists tells whether the node-set expression selects any node.
+func exists(e Expr, ctx *Context) bool {
+	if e, ok := e.(existential); ok {
+		return e.exists(ctx)
+	}
+	return len(nodeSet(e.Eval(ctx))) > 0
+}
+
 type predicates []Expr
 
-func (p predicates) eval(ns []dom.Node, vars Variables) []dom.Node {
+func (p predicates) eval(ns []dom.Node, ctx *Context) []dom.Node {
 	for _, predicate := range p {
 		var pr []dom.Node
-		scontext := &Context{nil, 0, len(ns), vars}
+		scontext := ctx.push(nil, 0, len(ns))
 		for _, n := range ns {
 			scontext.Node = n
 			scontext.Pos++
+			if e, ok := predicate.(existential); ok {
+				if e.exists(scontext) {
+					pr = append(pr, n)
+				}
+				continue
+			}
 			pval := predicate.Eval(scontext)
 			if i, ok := pval.(float64); ok {
 				if scontext.Pos == int(i) {
@@ -336,6 +369,7 @@ func (p predicates) eval(ns []dom.Node, vars Variables) []dom.Node {
 				pr = append(pr, n)
 			}
 		}
+		releaseContext(scontext)
 		ns = pr
 	}
 	return ns
@@ -353,22 +387,66 @@ func (*locationPath) Returns() DataType {
 }
 
 func (e *locationPath) Eval(ctx *Context) interface{} {
-	var ns []dom.Node
-	if e.abs {
-		ns = []dom.Node{ctx.Document()}
-	} else {
-		ns = []dom.Node{ctx.Node}
+	return e.evalWith(e.start(ctx), ctx)
+}
+
+func (e *locationPath) start(ctx *Context) []dom.Node {
+	switch {
+	case e.abs && ctx.Root != nil:
+		return []dom.Node{ctx.Root}
+	case e.abs:
+		return []dom.Node{root(ctx.Node)}
+	default:
+		return []dom.Node{ctx.Node}
+	}
+}
+
+func (e *locationPath) exists(ctx *Context) bool {
+	seen := make([]map[dom.Node]struct{}, len(e.steps))
+	for i := range seen {
+		seen[i] = make(map[dom.Node]struct{})
+	}
+	return existsFrom(e.steps, seen, e.start(ctx), ctx)
+}
+
+// existsFrom tells whether steps select any node from the context nodes ns.
+// It searches depth first and stops at first node found. seen[i] tracks
+// the context nodes already searched with steps[i:], which found nothing.
+func existsFrom(steps []*step, seen []map[dom.Node]struct{}, ns []dom.Node, ctx *Context) bool {
+	if len(steps) == 0 {
+		return len(ns) > 0
+	}
+	s := steps[0]
+	for _, c := range ns {
+		if _, ok := seen[0][c]; ok {
+			continue
+		}
+		seen[0][c] = struct{}{}
+		if len(s.predicates) > 0 {
+			if existsFrom(steps[1:], seen[1:], s.evalNode(c, nil, ctx), ctx) {
+				return true
+			}
+			continue
+		}
+		iter := s.iter(c)
+		ctx.record(c)
+		for n := iter.Next(); n != nil; n = iter.Next() {
+			ctx.visit(n)
+			if s.test(n) && existsFrom(steps[1:], seen[1:], []dom.Node{n}, ctx) {
+				return true
+			}
+		}
 	}
-	return e.evalWith(ns, ctx)
+	return false
 }
 
 func (e *locationPath) evalWith(ns []dom.Node, ctx *Context) interface{} {
 	orderReqd := len(ns) > 1 || len(e.steps) > 1
 	for _, s := range e.steps {
-		ns = s.eval(ns, ctx.Vars)
+		ns = s.eval(ns, ctx)
 	}
 	if orderReqd {
-		order(ns)
+		order(ns, ctx)
 	}
 	return ns
 }
@@ -389,28 +467,12 @@ type step struct {
 	reverse    bool
 }
 
-func (s *step) eval(ctx []dom.Node, vars Variables) []dom.Node {
+func (s *step) eval(ns []dom.Node, ctx *Context) []dom.Node {
 	var r []dom.Node
 	unique := make(map[dom.Node]struct{})
 
-	for _, c := range ctx {
-		var cr []dom.Node
-		iter := s.iter(c)
-
-		// eval test
-		for {
-			n := iter.Next()
-			if n == nil {
-				break
-			}
-			if _, ok := unique[n]; !ok && s.test(n) {
-				unique[n] = struct{}{}
-				cr = append(cr, n)
-			}
-		}
-
-		cr = s.predicates.eval(cr, vars)
-		r = append(r, cr...)
+	for _, c := range ns {
+		r = append(r, s.evalNode(c, unique, ctx)...)
 	}
 
 	if s.reverse {
@@ -419,6 +481,33 @@ func (s *step) eval(ctx []dom.Node, vars Variables) []dom.Node {
 	return r
 }
 
+// evalNode returns the nodes selected by the step from
+// context node c. Nodes in unique are skipped, if it is not nil.
+func (s *step) evalNode(c dom.Node, unique map[dom.Node]struct{}, ctx *Context) []dom.Node {
+	var cr []dom.Node
+	iter := s.iter(c)
+	ctx.record(c)
+
+	// eval test
+	for {
+		n := iter.Next()
+		if n == nil {
+			break
+		}
+		ctx.visit(n)
+		if unique == nil {
+			if s.test(n) {
+				cr = append(cr, n)
+			}
+		} else if _, ok := unique[n]; !ok && s.test(n) {
+			unique[n] = struct{}{}
+			cr = append(cr, n)
+		}
+	}
+
+	return s.predicates.eval(cr, ctx)
+}
+
 /************************************************************************/
 
 type filterExpr struct {
@@ -431,7 +520,7 @@ func (*filterExpr) Returns() DataType {
 }
 
 func (e *filterExpr) Eval(ctx *Context) interface{} {
-	return e.predicates.eval(e.expr.Eval(ctx).([]dom.Node), ctx.Vars)
+	return e.predicates.eval(nodeSet(e.expr.Eval(ctx)), ctx)
 }
 
 func (e *filterExpr) Simplify() Expr {
@@ -454,7 +543,7 @@ func (*pathExpr) Returns() DataType {
 }
 
 func (e *pathExpr) Eval(ctx *Context) interface{} {
-	ns := e.filter.Eval(ctx).([]dom.Node)
+	ns := nodeSet(e.filter.Eval(ctx))
 	return e.locationPath.evalWith(ns, ctx)
 }
 
@@ -479,7 +568,17 @@ func (v *variable) Eval(ctx *Context) interface{} {
 	if ctx.Vars == nil {
 		panic(UnresolvedVariableError(v.name))
 	}
-	r := ctx.Vars.Eval(v.name)
+	var r interface{}
+	if vars, ok := ctx.Vars.(VariablesErr); ok {
+		var err error
+		if r, err = vars.EvalVar(v.name); err != nil {
+			panic(err)
+		}
+	} else if vars, ok := ctx.Vars.(LazyVariables); ok {
+		r = ctx.lazyVar(vars, v.name)
+	} else {
+		r = ctx.Vars.Eval(v.name)
+	}
 	if r == nil {
 		panic(UnresolvedVariableError(v.name))
 	}
@@ -521,3 +620,110 @@ func (e *funcCall) Simplify() Expr {
 	}
 	return e
 }
+
+/************************************************************************/
+
+// dynamicFuncCall is a function call that is resolved at evaluation time.
+type dynamicFuncCall struct {
+	name      string
+	args      []Expr
+	functions Functions
+	strict    bool
+}
+
+func (*dynamicFuncCall) Returns() DataType {
+	return Any
+}
+
+func (e *dynamicFuncCall) Eval(ctx *Context) interface{} {
+	f := e.functions.Resolve(e.name)
+	if f == nil {
+		panic(UnresolvedFunctionError(e.name))
+	}
+	if !f.Args.Valid() {
+		panic(SignatureError(e.name))
+	}
+	if !f.Args.canAccept(len(e.args)) {
+		panic(ArgCountError(e.name))
+	}
+	args := make([]Expr, len(e.args))
+	for i, arg := range e.args {
+		v := arg.Eval(ctx)
+		switch t := f.Args.typeOf(i); t {
+		case NodeSet:
+			if TypeOf(v) != NodeSet {
+				panic(ConversionError{TypeOf(v), NodeSet})
+			}
+		case String:
+			v = ctx.value2String(v)
+		case Number:
+			v = Value2Number(v)
+		case Boolean:
+			v = Value2Boolean(v)
+		}
+		args[i] = valueExpr{v}
+	}
+	expr := f.Compile(f, args)
+	if e.strict {
+		expr = &returnCheck{e.name, expr.Returns(), expr}
+	}
+	r := expr.Eval(ctx)
+	// the function is not known at compile time,
+	// so its result is validated here
+	switch r.(type) {
+	case []dom.Node, string, float64, bool:
+	default:
+		panic(InvalidValueError{r})
+	}
+	return r
+}
+
+func (e *dynamicFuncCall) Simplify() Expr {
+	for i := range e.args {
+		e.args[i] = Simplify(e.args[i])
+	}
+	return e
+}
+
+/************************************************************************/
+
+// returnCheck verifies that the function call returns value of
+// the DataType, it declared when compiled. See Compiler.StrictFunctions.
+type returnCheck struct {
+	name    string
+	returns DataType
+	expr    Expr
+}
+
+func (e *returnCheck) Returns() DataType {
+	return e.returns
+}
+
+func (e *returnCheck) Eval(ctx *Context) interface{} {
+	r := e.expr.Eval(ctx)
+	if t := TypeOf(r); e.returns != Any && t != e.returns {
+		panic(ReturnTypeError{e.name, e.returns, t})
+	}
+	return r
+}
+
+func (e *returnCheck) Simplify() Expr {
+	e.expr = Simplify(e.expr)
+	if Literals(e.expr) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+// valueExpr wraps an already evaluated value.
+type valueExpr struct {
+	val interface{}
+}
+
+func (e valueExpr) Returns() DataType {
+	return TypeOf(e.val)
+}
+
+func (e valueExpr) Eval(ctx *Context) interface{} {
+	return e.val
+}
@@ -0,0 +1,500 @@
+// Copyright 2017 Santhosh Kumar Tekuri. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xpath
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/santhosh-tekuri/dom"
+)
+
+// Namespace URIs of the EXSLT modules supported.
+//
+// See http://exslt.org/.
+const (
+	// EXSLTStrings is namespace uri of the EXSLT strings module.
+	EXSLTStrings = "http://exslt.org/strings"
+
+	// EXSLTDates is namespace uri of the EXSLT dates and times module.
+	EXSLTDates = "http://exslt.org/dates-and-times"
+
+	// EXSLTMath is namespace uri of the EXSLT math module.
+	EXSLTMath = "http://exslt.org/math"
+
+	// EXSLTSets is namespace uri of the EXSLT sets module.
+	EXSLTSets = "http://exslt.org/sets"
+)
+
+var exsltStrings = map[string]*Function{
+	"padding": {
+		String, Args{Mandatory(Number), Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 1 {
+				return &padding{args[0], stringVal(" "), 0}
+			}
+			return &padding{args[0], args[1], 0}
+		}},
+	"align": {
+		String, Args{Mandatory(String), Mandatory(String), Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 2 {
+				return &align{args[0], args[1], stringVal("left")}
+			}
+			return &align{args[0], args[1], args[2]}
+		}},
+	"replace": {
+		String, Args{Mandatory(String), Mandatory(NodeSet), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &strReplace{args[0], args[1], args[2]}
+		}},
+	"concat": {
+		String, Args{Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &strConcat{args[0]}
+		}},
+}
+
+var exsltDates = map[string]*Function{
+	"date-time": {
+		String, nil,
+		func(f *Function, args []Expr) Expr {
+			return &dateTime{}
+		}},
+	"year": {
+		Number, Args{Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			return newDateFunc(args, dateYear)
+		}},
+	"month-in-year": {
+		Number, Args{Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			return newDateFunc(args, dateMonthInYear)
+		}},
+	"day-in-month": {
+		Number, Args{Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			return newDateFunc(args, dateDayInMonth)
+		}},
+	"seconds": {
+		Number, Args{Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			return newDateFunc(args, dateSeconds)
+		}},
+}
+
+var exsltMath = map[string]*Function{
+	"random": {
+		Number, nil,
+		func(f *Function, args []Expr) Expr {
+			return &random{defaultRand}
+		}},
+}
+
+var exsltSets = map[string]*Function{
+	"intersection": {
+		NodeSet, Args{Mandatory(NodeSet), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &setExpr{args[0], args[1], intersectNodes}
+		}},
+	"difference": {
+		NodeSet, Args{Mandatory(NodeSet), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &setExpr{args[0], args[1], exceptNodes}
+		}},
+}
+
+func init() {
+	for uri, functions := range map[string]map[string]*Function{
+		EXSLTStrings: exsltStrings,
+		EXSLTDates:   exsltDates,
+		EXSLTMath:    exsltMath,
+		EXSLTSets:    exsltSets,
+	} {
+		for local, f := range functions {
+			coreFunctions[ClarkName(uri, local)] = f
+		}
+	}
+}
+
+/************************************************************************/
+
+// padding panics with PaddingLengthError, if length is more than
+// Compiler.MaxPaddingLength.
+type padding struct {
+	length Expr
+	str    Expr
+	max    int
+}
+
+func (*padding) Returns() DataType {
+	return String
+}
+
+func (e *padding) Eval(ctx *Context) interface{} {
+	length := e.length.Eval(ctx).(float64)
+	str := e.str.Eval(ctx).(string)
+	if str == "" || math.IsNaN(length) || length < 1 {
+		return ""
+	}
+	if math.Floor(length) > float64(e.max) {
+		panic(PaddingLengthError(e.max))
+	}
+	n := int(length)
+	strLength := utf8.RuneCountInString(str)
+	s := strings.Repeat(str, (n+strLength-1)/strLength)
+	if strLength == len(str) {
+		return s[:n]
+	}
+	return string([]rune(s)[:n])
+}
+
+func (e *padding) configure(c *Compiler, depth int) Expr {
+	e.max = c.MaxPaddingLength
+	if e.max <= 0 {
+		e.max = 1048576
+	}
+	return e
+}
+
+func (e *padding) Simplify() Expr {
+	e.length, e.str = Simplify(e.length), Simplify(e.str)
+	if Literals(e.length, e.str) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+type align struct {
+	str       Expr
+	padding   Expr
+	alignment Expr
+}
+
+func (*align) Returns() DataType {
+	return String
+}
+
+func (e *align) Eval(ctx *Context) interface{} {
+	str := []rune(e.str.Eval(ctx).(string))
+	padding := []rune(e.padding.Eval(ctx).(string))
+	if len(str) >= len(padding) {
+		return string(str[:len(padding)])
+	}
+	var from int
+	switch e.alignment.Eval(ctx).(string) {
+	case "right":
+		from = len(padding) - len(str)
+	case "center":
+		from = (len(padding) - len(str)) / 2
+	}
+	copy(padding[from:], str)
+	return string(padding)
+}
+
+func (e *align) Simplify() Expr {
+	e.str, e.padding, e.alignment = Simplify(e.str), Simplify(e.padding), Simplify(e.alignment)
+	if Literals(e.str, e.padding, e.alignment) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// strReplace replaces all occurrences of search strings
+// with the corresponding replacement strings simultaneously.
+//
+// The string is scanned from left to right. If more than one search string
+// matches at a position, the longest one is used, and among equal search
+// strings the first one is used. The text replaced is not scanned again.
+// If there is no replacement for a search string, its occurrences are deleted.
+type strReplace struct {
+	str     Expr
+	search  Expr
+	replace Expr
+}
+
+func (*strReplace) Returns() DataType {
+	return String
+}
+
+func (e *strReplace) Eval(ctx *Context) interface{} {
+	str := e.str.Eval(ctx).(string)
+	var search, replace []string
+	for _, n := range nodeSet(e.search.Eval(ctx)) {
+		search = append(search, ctx.node2String(n))
+	}
+	for _, n := range nodeSet(e.replace.Eval(ctx)) {
+		replace = append(replace, ctx.node2String(n))
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(str)))
+	for i := 0; i < len(str); {
+		match := -1
+		for j, s := range search {
+			if s != "" && strings.HasPrefix(str[i:], s) && (match == -1 || len(s) > len(search[match])) {
+				match = j
+			}
+		}
+		if match == -1 {
+			_, size := utf8.DecodeRuneInString(str[i:])
+			buf.WriteString(str[i : i+size])
+			i += size
+			continue
+		}
+		if match < len(replace) {
+			buf.WriteString(replace[match])
+		}
+		i += len(search[match])
+	}
+	return buf.String()
+}
+
+/************************************************************************/
+
+// strConcat concatenates the string-values of all nodes in node-set.
+type strConcat struct {
+	arg Expr
+}
+
+func (*strConcat) Returns() DataType {
+	return String
+}
+
+func (e *strConcat) Eval(ctx *Context) interface{} {
+	buf := new(bytes.Buffer)
+	for _, n := range nodeSet(e.arg.Eval(ctx)) {
+		buf.WriteString(ctx.node2String(n))
+	}
+	return buf.String()
+}
+
+/************************************************************************/
+
+const dateTimeLayout = "2006-01-02T15:04:05Z07:00"
+
+// dateLayouts are the layouts of xs:dateTime, xs:date, xs:gYearMonth and xs:gYear.
+var dateLayouts = []string{
+	dateTimeLayout,
+	"2006-01-02T15:04:05",
+	"2006-01-02Z07:00",
+	"2006-01-02",
+	"2006-01Z07:00",
+	"2006-01",
+	"2006Z07:00",
+	"2006",
+}
+
+// parseDate parses the ISO 8601 date/time string and returns the
+// layout matched. Date/time without timezone is treated as UTC.
+func parseDate(s string) (time.Time, string, bool) {
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, layout, true
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// dateTime returns the current date/time. The value is same
+// for all calls during an evaluation.
+type dateTime struct{}
+
+func (dateTime) Returns() DataType {
+	return String
+}
+
+func (dateTime) Eval(ctx *Context) interface{} {
+	return ctx.now().Format(dateTimeLayout)
+}
+
+/************************************************************************/
+
+// dateFunc applies a function on the date/time string.
+// If str is nil, the current date/time is used.
+type dateFunc struct {
+	str   Expr
+	apply func(s string) float64
+}
+
+func newDateFunc(args []Expr, apply func(s string) float64) Expr {
+	if len(args) == 0 {
+		return &dateFunc{nil, apply}
+	}
+	return &dateFunc{args[0], apply}
+}
+
+func (*dateFunc) Returns() DataType {
+	return Number
+}
+
+func (e *dateFunc) Eval(ctx *Context) interface{} {
+	if e.str == nil {
+		return e.apply(ctx.now().Format(dateTimeLayout))
+	}
+	return e.apply(e.str.Eval(ctx).(string))
+}
+
+func (e *dateFunc) Simplify() Expr {
+	if e.str == nil {
+		return e
+	}
+	e.str = Simplify(e.str)
+	if Literals(e.str) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+func dateYear(s string) float64 {
+	if t, _, ok := parseDate(s); ok {
+		return float64(t.Year())
+	}
+	return math.NaN()
+}
+
+func dateMonthInYear(s string) float64 {
+	if t, layout, ok := parseDate(s); ok && strings.Contains(layout, "-01") {
+		return float64(t.Month())
+	}
+	return math.NaN()
+}
+
+func dateDayInMonth(s string) float64 {
+	if t, layout, ok := parseDate(s); ok && strings.Contains(layout, "-02") {
+		return float64(t.Day())
+	}
+	return math.NaN()
+}
+
+var durationRegexp = regexp.MustCompile(`^(-)?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// dateSeconds returns the number of seconds in xs:duration, or
+// the number of seconds since 1970-01-01T00:00:00Z for date/time.
+//
+// Durations with years or months give NaN, because
+// their length in seconds is not fixed.
+func dateSeconds(s string) float64 {
+	if m := durationRegexp.FindStringSubmatch(s); m != nil {
+		if strings.HasSuffix(s, "P") || strings.HasSuffix(s, "T") || m[2] != "" || m[3] != "" {
+			return math.NaN()
+		}
+		var secs float64
+		for i, unit := range []float64{24 * 60 * 60, 60 * 60, 60, 1} {
+			if v := m[4+i]; v != "" {
+				f, _ := strconv.ParseFloat(v, 64)
+				secs += f * unit
+			}
+		}
+		if m[1] != "" {
+			secs = -secs
+		}
+		return secs
+	}
+	if t, _, ok := parseDate(s); ok {
+		return float64(t.UnixNano()) / float64(time.Second)
+	}
+	return math.NaN()
+}
+
+/************************************************************************/
+
+var defaultRand = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano())})
+
+// random returns a random number in [0,1).
+//
+// It does not implement Simplify, because it must
+// not be evaluated at compile time.
+type random struct {
+	rand *rand.Rand
+}
+
+func (*random) Returns() DataType {
+	return Number
+}
+
+func (e *random) Eval(ctx *Context) interface{} {
+	return e.rand.Float64()
+}
+
+func (e *random) configure(c *Compiler, depth int) Expr {
+	if c.RandSource != nil {
+		e.rand = rand.New(c.RandSource)
+	}
+	return e
+}
+
+// lockedSource is rand.Source which is safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+/************************************************************************/
+
+// setExpr applies set operation on two node-sets.
+type setExpr struct {
+	lhs   Expr
+	rhs   Expr
+	apply func(ns1, ns2 []dom.Node) []dom.Node
+}
+
+func (*setExpr) Returns() DataType {
+	return NodeSet
+}
+
+func (e *setExpr) Eval(ctx *Context) interface{} {
+	ns := e.apply(nodeSet(e.lhs.Eval(ctx)), nodeSet(e.rhs.Eval(ctx)))
+	order(ns, ctx)
+	return ns
+}
+
+// intersectNodes returns the nodes in ns1 that are also in ns2.
+// Nodes are compared by identity.
+func intersectNodes(ns1, ns2 []dom.Node) []dom.Node {
+	return filterNodes(ns1, ns2, true)
+}
+
+// exceptNodes returns the nodes in ns1 that are not in ns2.
+// Nodes are compared by identity.
+func exceptNodes(ns1, ns2 []dom.Node) []dom.Node {
+	return filterNodes(ns1, ns2, false)
+}
+
+func filterNodes(ns1, ns2 []dom.Node, in bool) []dom.Node {
+	set := make(map[dom.Node]struct{}, len(ns2))
+	for _, n := range ns2 {
+		set[n] = struct{}{}
+	}
+	var r []dom.Node
+	for _, n := range ns1 {
+		if _, ok := set[n]; ok == in {
+			r = append(r, n)
+		}
+	}
+	return r
+}
@@ -0,0 +1,1797 @@
+// Copyright 2017 Santhosh Kumar Tekuri. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xpath
+
+import (
+	"bytes"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/santhosh-tekuri/dom"
+	xpath "github.com/santhosh-tekuri/xpathparser"
+)
+
+// ExtensionNS is the namespace uri of the extension functions
+// provided by this package. These functions are not part of
+// xpath 1.0 specification.
+const ExtensionNS = "https://github.com/santhosh-tekuri/xpath"
+
+var extFunctions = map[string]*Function{
+	"encode-for-uri": {
+		String, Args{Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &encodeURI{args[0], isUnreserved}
+		}},
+	"iri-to-uri": {
+		String, Args{Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &encodeURI{args[0], isAllowedInURI}
+		}},
+	"string-to-codepoints": {
+		NodeSet, Args{Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &stringToCodepoints{args[0]}
+		}},
+	"codepoints-to-string": {
+		String, Args{Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &codepointsToString{args[0]}
+		}},
+	"compare": {
+		Number, Args{Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &compare{args[0], args[1], nil}
+		}},
+	"subsequence": {
+		NodeSet, Args{Mandatory(NodeSet), Mandatory(Number), Optional(Number)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 2 {
+				return &subsequence{args[0], args[1], nil}
+			}
+			return &subsequence{args[0], args[1], args[2]}
+		}},
+	"function-available": {
+		Boolean, Args{Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &functionAvailable{args[0]}
+		}},
+	"base-uri": {
+		String, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &baseURI{nil, ""}
+			}
+			return &baseURI{args[0], ""}
+		}},
+	"kind": {
+		String, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &kind{ContextExpr{}}
+			}
+			return &kind{args[0]}
+		}},
+	"has-children": {
+		Boolean, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &hasChildren{ContextExpr{}}
+			}
+			return &hasChildren{args[0]}
+		}},
+	"has-attributes": {
+		Boolean, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &hasAttributes{ContextExpr{}}
+			}
+			return &hasAttributes{args[0]}
+		}},
+	"round-half-to-even": {
+		Number, Args{Mandatory(Number), Optional(Number)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 1 {
+				return &roundHalfToEven{args[0], numberVal(0)}
+			}
+			return &roundHalfToEven{args[0], args[1]}
+		}},
+	"parse-date": {
+		Number, Args{Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &parseDateLayout{args[0], args[1]}
+		}},
+	"pi-data": {
+		String, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &piData{ContextExpr{}}
+			}
+			return &piData{args[0]}
+		}},
+	"starts-with-any": {
+		Boolean, Args{Mandatory(String), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &affixAny{args[0], args[1], false, nil}
+		}},
+	"ends-with-any": {
+		Boolean, Args{Mandatory(String), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &affixAny{args[0], args[1], true, nil}
+		}},
+	"reverse": {
+		NodeSet, Args{Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &reverseFunc{args[0]}
+		}},
+	"word-count": {
+		Number, Args{Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &wordCount{asString(ContextExpr{})}
+			}
+			return &wordCount{args[0]}
+		}},
+	"regex-group": {
+		String, Args{Mandatory(String), Mandatory(String), Mandatory(Number)},
+		func(f *Function, args []Expr) Expr {
+			return &regexGroup{args[0], args[1], args[2], nil}
+		}},
+	"namespace-uri-for-prefix": {
+		String, Args{Mandatory(String), Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 1 {
+				return &namespaceURIForPrefix{args[0], ContextExpr{}}
+			}
+			return &namespaceURIForPrefix{args[0], args[1]}
+		}},
+	"sort": {
+		NodeSet, Args{Mandatory(NodeSet), Mandatory(String), Optional(String), Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			e := &sortFunc{ns: args[0], keyStr: args[1]}
+			if len(args) > 2 {
+				e.dataType = args[2]
+			}
+			if len(args) > 3 {
+				e.order = args[3]
+			}
+			return e
+		}},
+	"trim-prefix": {
+		String, Args{Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &trimAffix{args[0], args[1], false}
+		}},
+	"trim-suffix": {
+		String, Args{Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &trimAffix{args[0], args[1], true}
+		}},
+	"starts-with-ci": {
+		Boolean, Args{Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &matchCI{args[0], args[1], CaseInsensitive.HasPrefix}
+		}},
+	"ends-with-ci": {
+		Boolean, Args{Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &matchCI{args[0], args[1], CaseInsensitive.HasSuffix}
+		}},
+	"contains-ci": {
+		Boolean, Args{Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &matchCI{args[0], args[1], CaseInsensitive.Contains}
+		}},
+	"replace-first": {
+		String, Args{Mandatory(String), Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &replaceFirst{args[0], args[1], args[2], nil}
+		}},
+	"match-count": {
+		Number, Args{Mandatory(String), Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &matchCount{args[0], args[1], nil}
+		}},
+	"node-path": {
+		String, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &nodePathFunc{ContextExpr{}}
+			}
+			return &nodePathFunc{args[0]}
+		}},
+	"normalize-space-unicode": {
+		String, Args{Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &normalizeSpaceUnicode{asString(ContextExpr{})}
+			}
+			return &normalizeSpaceUnicode{args[0]}
+		}},
+	"is-descendant": {
+		Boolean, Args{Mandatory(NodeSet), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &isDescendant{args[0], args[1]}
+		}},
+	"is-ancestor": {
+		Boolean, Args{Mandatory(NodeSet), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &isDescendant{args[1], args[0]}
+		}},
+	"following-text": {
+		String, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &adjacentText{ContextExpr{}, false}
+			}
+			return &adjacentText{args[0], false}
+		}},
+	"preceding-text": {
+		String, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &adjacentText{ContextExpr{}, true}
+			}
+			return &adjacentText{args[0], true}
+		}},
+	"position": {
+		Number, Args{Mandatory(Number)},
+		func(f *Function, args []Expr) Expr {
+			return &outerPosition{args[0]}
+		}},
+	"is-ncname": {
+		Boolean, Args{Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &isName{args[0], false}
+		}},
+	"is-qname": {
+		Boolean, Args{Mandatory(String)},
+		func(f *Function, args []Expr) Expr {
+			return &isName{args[0], true}
+		}},
+	"round-sig": {
+		Number, Args{Mandatory(Number), Mandatory(Number)},
+		func(f *Function, args []Expr) Expr {
+			return &roundSig{args[0], args[1]}
+		}},
+	"distinct-names": {
+		NodeSet, Args{Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &distinctNames{args[0]}
+		}},
+	"index-of": {
+		Number, Args{Mandatory(NodeSet), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &indexOf{args[0], args[1]}
+		}},
+	"root": {
+		NodeSet, Args{Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &rootFunc{}
+			}
+			return &rootFunc{args[0]}
+		}},
+	"range": {
+		NodeSet, Args{Mandatory(Number), Mandatory(Number)},
+		func(f *Function, args []Expr) Expr {
+			return &rangeFunc{start: args[0], end: args[1]}
+		}},
+	"byte-length": {
+		Number, Args{Optional(String)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 0 {
+				return &byteLength{asString(ContextExpr{})}
+			}
+			return &byteLength{args[0]}
+		}},
+	"distinct-count": {
+		Number, Args{Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &distinctCount{args[0]}
+		}},
+	"ancestor-named": {
+		NodeSet, Args{Mandatory(String), Optional(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			if len(args) == 1 {
+				return &ancestorNamed{name: args[0]}
+			}
+			return &ancestorNamed{name: args[0], ns: args[1]}
+		}},
+	"are-siblings": {
+		Boolean, Args{Mandatory(NodeSet), Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &areSiblings{args[0], args[1]}
+		}},
+	"owner": {
+		NodeSet, Args{Mandatory(NodeSet)},
+		func(f *Function, args []Expr) Expr {
+			return &owner{args[0]}
+		}},
+}
+
+func init() {
+	for local, f := range extFunctions {
+		coreFunctions[ClarkName(ExtensionNS, local)] = f
+	}
+}
+
+/************************************************************************/
+
+// encodeURI percent-encodes the utf-8 bytes of string,
+// which are not accepted by keep.
+type encodeURI struct {
+	str  Expr
+	keep func(b byte) bool
+}
+
+func (*encodeURI) Returns() DataType {
+	return String
+}
+
+func (e *encodeURI) Eval(ctx *Context) interface{} {
+	const hex = "0123456789ABCDEF"
+	str := e.str.Eval(ctx).(string)
+	buf := bytes.NewBuffer(make([]byte, 0, len(str)))
+	for i := 0; i < len(str); i++ {
+		b := str[i]
+		if e.keep(b) {
+			buf.WriteByte(b)
+		} else {
+			buf.WriteByte('%')
+			buf.WriteByte(hex[b>>4])
+			buf.WriteByte(hex[b&0xF])
+		}
+	}
+	return buf.String()
+}
+
+func (e *encodeURI) Simplify() Expr {
+	e.str = Simplify(e.str)
+	if Literals(e.str) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+// isUnreserved tells whether b is in unreserved set of RFC 3986.
+func isUnreserved(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	switch b {
+	case '-', '_', '.', '~':
+		return true
+	}
+	return false
+}
+
+// isAllowedInURI tells whether b can appear in URI without escaping.
+// Note that '%' is not escaped.
+func isAllowedInURI(b byte) bool {
+	if b <= 0x20 || b >= 0x7F {
+		return false
+	}
+	switch b {
+	case '<', '>', '"', '{', '}', '|', '\\', '^', '`':
+		return false
+	}
+	return true
+}
+
+/************************************************************************/
+
+// sequence returns a node-set of text nodes, one for each of the given values.
+//
+// XPath 1.0 has no sequences. So functions returning sequence of atomic values
+// return such node-set. The text nodes are appended to a document node, that is
+// shared by all such calls in an evaluation. Thus the document order of node-set
+// is same as that of values, and the nodes of a call precede those of later calls.
+func sequence(ctx *Context, values []string) []dom.Node {
+	var doc *dom.Document
+	if ctx != nil && ctx.state != nil {
+		if ctx.state.sequence == nil {
+			ctx.state.sequence = new(dom.Document)
+		}
+		doc = ctx.state.sequence
+	} else {
+		doc = new(dom.Document)
+	}
+	ns := make([]dom.Node, len(values))
+	for i, v := range values {
+		ns[i] = &dom.Text{ParentNode: doc, Data: v}
+	}
+	doc.ChildNodes = append(doc.ChildNodes, ns...)
+	return ns
+}
+
+/************************************************************************/
+
+type stringToCodepoints struct {
+	str Expr
+}
+
+func (*stringToCodepoints) Returns() DataType {
+	return NodeSet
+}
+
+func (e *stringToCodepoints) Eval(ctx *Context) interface{} {
+	var values []string
+	for _, r := range e.str.Eval(ctx).(string) {
+		values = append(values, strconv.Itoa(int(r)))
+	}
+	return sequence(ctx, values)
+}
+
+/************************************************************************/
+
+type codepointsToString struct {
+	arg Expr
+}
+
+func (*codepointsToString) Returns() DataType {
+	return String
+}
+
+func (e *codepointsToString) Eval(ctx *Context) interface{} {
+	buf := new(bytes.Buffer)
+	for _, n := range nodeSet(e.arg.Eval(ctx)) {
+		cp := ctx.node2Number(n)
+		if cp != math.Trunc(cp) || cp < 0 || cp > utf8.MaxRune || !utf8.ValidRune(rune(cp)) {
+			panic(InvalidCodepointError(cp))
+		}
+		buf.WriteRune(rune(cp))
+	}
+	return buf.String()
+}
+
+/************************************************************************/
+
+type compare struct {
+	s1        Expr
+	s2        Expr
+	collation Collation
+}
+
+func (*compare) Returns() DataType {
+	return Number
+}
+
+func (e *compare) Eval(ctx *Context) interface{} {
+	s1, s2 := e.s1.Eval(ctx).(string), e.s2.Eval(ctx).(string)
+	var c int
+	if e.collation != nil {
+		c = e.collation.Compare(s1, s2)
+	} else {
+		c = strings.Compare(s1, s2)
+	}
+	switch {
+	case c < 0:
+		return float64(-1)
+	case c > 0:
+		return float64(1)
+	default:
+		return float64(0)
+	}
+}
+
+func (e *compare) configure(c *Compiler, depth int) Expr {
+	e.collation = c.Collation
+	return e
+}
+
+func (e *compare) Simplify() Expr {
+	e.s1, e.s2 = Simplify(e.s1), Simplify(e.s2)
+	if Literals(e.s1, e.s2) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// subsequence returns the nodes whose position p in document order
+// satisfies round(start) <= p < round(start)+round(length).
+type subsequence struct {
+	ns     Expr
+	start  Expr
+	length Expr
+}
+
+func (*subsequence) Returns() DataType {
+	return NodeSet
+}
+
+func (e *subsequence) Eval(ctx *Context) interface{} {
+	ns := append([]dom.Node(nil), nodeSet(e.ns.Eval(ctx))...)
+	from := math.Floor(e.start.Eval(ctx).(float64) + 0.5)
+	to := math.Inf(+1)
+	if e.length != nil {
+		to = from + math.Floor(e.length.Eval(ctx).(float64)+0.5)
+	}
+	if math.IsNaN(from) || math.IsNaN(to) {
+		return []dom.Node(nil)
+	}
+	order(ns, ctx)
+	from = math.Max(from, 1)
+	to = math.Min(to, float64(len(ns)+1))
+	if from >= to {
+		return []dom.Node(nil)
+	}
+	return ns[int(from)-1 : int(to)-1]
+}
+
+/************************************************************************/
+
+// functionAvailable tells whether the function with given qname
+// can be resolved by the compiler. It is evaluated at compile time,
+// so its argument must be literal.
+type functionAvailable struct {
+	name Expr
+}
+
+func (*functionAvailable) Returns() DataType {
+	return Boolean
+}
+
+func (e *functionAvailable) Eval(ctx *Context) interface{} {
+	panic("BUG: function-available must be evaluated at compile time")
+}
+
+func (e *functionAvailable) configure(c *Compiler, depth int) Expr {
+	name, ok := Simplify(e.name).(stringVal)
+	if !ok {
+		panic(LiteralArgError(ClarkName(ExtensionNS, "function-available")))
+	}
+	prefix, local := "", string(name)
+	if colon := strings.IndexByte(local, ':'); colon != -1 {
+		prefix, local = local[:colon], local[colon+1:]
+	}
+	fname := ClarkName(c.resolvePrefix(prefix), local)
+	if c.resolveFunction(fname) != nil {
+		return booleanVal(true)
+	}
+	return booleanVal(c.DynamicFunctions != nil && c.DynamicFunctions.Resolve(fname) != nil)
+}
+
+/************************************************************************/
+
+// baseURI returns the base uri of the node, by resolving the
+// xml:base attributes of its ancestors against base, starting
+// from the outermost. If ns is nil, the context node is used.
+type baseURI struct {
+	ns   Expr
+	base string
+}
+
+func (*baseURI) Returns() DataType {
+	return String
+}
+
+func (e *baseURI) Eval(ctx *Context) interface{} {
+	n := ctx.Node
+	if e.ns != nil {
+		ns := nodeSet(e.ns.Eval(ctx))
+		if len(ns) == 0 {
+			return ""
+		}
+		n = ns[0]
+	}
+
+	var bases []string
+	for ; n != nil; n = Parent(n) {
+		if elem, ok := n.(*dom.Element); ok {
+			if attr := elem.GetAttr("http://www.w3.org/XML/1998/namespace", "base"); attr != nil {
+				bases = append(bases, attr.Value)
+			}
+		}
+	}
+	if e.base != "" {
+		bases = append(bases, e.base)
+	}
+
+	var base *url.URL
+	for i := len(bases) - 1; i >= 0; i-- {
+		ref, err := url.Parse(bases[i])
+		if err != nil {
+			return ""
+		}
+		if base == nil {
+			base = ref
+		} else {
+			base = base.ResolveReference(ref)
+		}
+	}
+	if base == nil {
+		return ""
+	}
+	return base.String()
+}
+
+func (e *baseURI) configure(c *Compiler, depth int) Expr {
+	e.base = c.BaseURI
+	return e
+}
+
+/************************************************************************/
+
+// kind returns the kind of first node in node-set. It
+// returns empty string, if the node-set is empty.
+type kind struct {
+	arg Expr
+}
+
+func (*kind) Returns() DataType {
+	return String
+}
+
+func (e *kind) Eval(ctx *Context) interface{} {
+	ns := nodeSet(e.arg.Eval(ctx))
+	if len(ns) > 0 {
+		switch ns[0].(type) {
+		case *dom.Document:
+			return "document"
+		case *dom.Element:
+			return "element"
+		case *dom.Attr:
+			return "attribute"
+		case *dom.Text:
+			return "text"
+		case *dom.Comment:
+			return "comment"
+		case *dom.ProcInst:
+			return "processing-instruction"
+		case *dom.NameSpace:
+			return "namespace"
+		}
+	}
+	return ""
+}
+
+/************************************************************************/
+
+// hasChildren tells whether first node in node-set has child elements.
+type hasChildren struct {
+	arg Expr
+}
+
+func (*hasChildren) Returns() DataType {
+	return Boolean
+}
+
+func (e *hasChildren) Eval(ctx *Context) interface{} {
+	ns := nodeSet(e.arg.Eval(ctx))
+	if len(ns) > 0 {
+		if p, ok := ns[0].(dom.Parent); ok {
+			for _, c := range p.Children() {
+				if _, ok := c.(*dom.Element); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+/************************************************************************/
+
+// hasAttributes tells whether first node in node-set has attributes.
+type hasAttributes struct {
+	arg Expr
+}
+
+func (*hasAttributes) Returns() DataType {
+	return Boolean
+}
+
+func (e *hasAttributes) Eval(ctx *Context) interface{} {
+	ns := nodeSet(e.arg.Eval(ctx))
+	if len(ns) > 0 {
+		if elem, ok := ns[0].(*dom.Element); ok {
+			return len(elem.Attrs) > 0
+		}
+	}
+	return false
+}
+
+/************************************************************************/
+
+// roundHalfToEven rounds the number to given number of fractional digits.
+// If the number is midway between two values, it is rounded to the one
+// whose last digit is even. Negative precision rounds to the left of
+// decimal point, for example precision -2 rounds to hundreds.
+type roundHalfToEven struct {
+	num       Expr
+	precision Expr
+}
+
+func (*roundHalfToEven) Returns() DataType {
+	return Number
+}
+
+func (e *roundHalfToEven) Eval(ctx *Context) interface{} {
+	num := e.num.Eval(ctx).(float64)
+	precision := math.Floor(e.precision.Eval(ctx).(float64) + 0.5)
+	switch {
+	case math.IsNaN(precision):
+		return math.NaN()
+	case math.IsNaN(num) || math.IsInf(num, 0) || num == 0:
+		return num
+	case precision >= 0:
+		scale := math.Pow10(int(math.Min(precision, 400)))
+		scaled := num * scale
+		if math.Abs(scaled) >= 1<<52 {
+			// no fractional digits left at this scale,
+			// scaling back would only lose precision.
+			return num
+		}
+		return math.RoundToEven(scaled) / scale
+	default:
+		scale := math.Pow10(int(math.Min(-precision, 400)))
+		if math.IsInf(scale, 0) {
+			return math.Copysign(0, num)
+		}
+		return math.RoundToEven(num/scale) * scale
+	}
+}
+
+func (e *roundHalfToEven) Simplify() Expr {
+	e.num, e.precision = Simplify(e.num), Simplify(e.precision)
+	if Literals(e.num, e.precision) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// parseDateLayout parses the string using the layout and returns
+// the number of seconds since 1970-01-01T00:00:00Z. It returns NaN,
+// if the string does not match the layout.
+//
+// The layout is Go time layout, which shows how the reference time
+// Mon Jan 2 15:04:05 MST 2006 would be formatted. for example
+// '2006-01-02 15:04:05'. See time.Parse for details. Date/time
+// without timezone is treated as UTC.
+type parseDateLayout struct {
+	str    Expr
+	layout Expr
+}
+
+func (*parseDateLayout) Returns() DataType {
+	return Number
+}
+
+func (e *parseDateLayout) Eval(ctx *Context) interface{} {
+	t, err := time.Parse(e.layout.Eval(ctx).(string), e.str.Eval(ctx).(string))
+	if err != nil {
+		return math.NaN()
+	}
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+func (e *parseDateLayout) Simplify() Expr {
+	e.str, e.layout = Simplify(e.str), Simplify(e.layout)
+	if Literals(e.str, e.layout) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// piData returns the data of first node in node-set, if it is
+// a processing-instruction. Otherwise it returns empty string.
+type piData struct {
+	arg Expr
+}
+
+func (*piData) Returns() DataType {
+	return String
+}
+
+func (e *piData) Eval(ctx *Context) interface{} {
+	ns := nodeSet(e.arg.Eval(ctx))
+	if len(ns) > 0 {
+		if pi, ok := ns[0].(*dom.ProcInst); ok {
+			return pi.Data
+		}
+	}
+	return ""
+}
+
+/************************************************************************/
+
+// affixAny tells whether the string starts with, or ends with
+// if suffix is true, the string-value of any node in affixes.
+type affixAny struct {
+	str       Expr
+	affixes   Expr
+	suffix    bool
+	collation Collation
+}
+
+func (*affixAny) Returns() DataType {
+	return Boolean
+}
+
+func (e *affixAny) Eval(ctx *Context) interface{} {
+	str := e.str.Eval(ctx).(string)
+	for _, n := range nodeSet(e.affixes.Eval(ctx)) {
+		affix := ctx.node2String(n)
+		var match bool
+		switch {
+		case e.collation != nil && e.suffix:
+			match = e.collation.HasSuffix(str, affix)
+		case e.collation != nil:
+			match = e.collation.HasPrefix(str, affix)
+		case e.suffix:
+			match = strings.HasSuffix(str, affix)
+		default:
+			match = strings.HasPrefix(str, affix)
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *affixAny) configure(c *Compiler, depth int) Expr {
+	e.collation = c.Collation
+	return e
+}
+
+/************************************************************************/
+
+// reverseFunc returns the nodes in reverse document order.
+//
+// Note that location path steps and union order their result in
+// document order. So the reverse order is seen only by consumers
+// of the result, like *XPath.EvalNodeSet and *XPath.EvalEach, and
+// by conversions and functions that use the first node of the
+// node-set, like string, number and name. Unlike xpath 1.0, they use
+// the first node in reverse order, i.e. the last in document order.
+type reverseFunc struct {
+	arg Expr
+}
+
+func (*reverseFunc) Returns() DataType {
+	return NodeSet
+}
+
+func (e *reverseFunc) Eval(ctx *Context) interface{} {
+	ns := append([]dom.Node(nil), nodeSet(e.arg.Eval(ctx))...)
+	order(ns, ctx)
+	reverse(ns)
+	return ns
+}
+
+/************************************************************************/
+
+// wordCount returns the number of tokens in the string, separated
+// by whitespace as in normalize-space.
+type wordCount struct {
+	arg Expr
+}
+
+func (*wordCount) Returns() DataType {
+	return Number
+}
+
+func (e *wordCount) Eval(ctx *Context) interface{} {
+	str := e.arg.Eval(ctx).(string)
+	count, inWord := 0, false
+	for i := 0; i < len(str); i++ {
+		if isSpace(str[i]) {
+			inWord = false
+		} else if !inWord {
+			inWord = true
+			count++
+		}
+	}
+	return float64(count)
+}
+
+func (e *wordCount) Simplify() Expr {
+	e.arg = Simplify(e.arg)
+	if Literals(e.arg) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// regexGroup returns the text matched by the given capture group, in
+// the first match of the regular expression in the string. Group 0 is
+// the whole match. It returns empty string, if there is no match or the
+// group does not exist. The syntax of the regular expression is that of
+// Go regexp package. The compiled regular expression is cached, if the
+// pattern is literal.
+type regexGroup struct {
+	str     Expr
+	pattern Expr
+	group   Expr
+	re      *regexp.Regexp
+}
+
+func (*regexGroup) Returns() DataType {
+	return String
+}
+
+func (e *regexGroup) Eval(ctx *Context) interface{} {
+	re := evalRegexp(e.re, e.pattern, ctx)
+	m := re.FindStringSubmatch(e.str.Eval(ctx).(string))
+	group := e.group.Eval(ctx).(float64)
+	if group < 0 || group >= float64(len(m)) || group != math.Trunc(group) {
+		return ""
+	}
+	return m[int(group)]
+}
+
+func (e *regexGroup) Simplify() Expr {
+	e.str, e.pattern, e.group = Simplify(e.str), Simplify(e.pattern), Simplify(e.group)
+	if Literals(e.pattern) {
+		e.re = compileRegexp(e.pattern.Eval(nil).(string))
+		if Literals(e.str, e.group) {
+			return Value2Expr(e.Eval(nil))
+		}
+	}
+	return e
+}
+
+/************************************************************************/
+
+// namespaceURIForPrefix returns the namespace uri bound to the prefix,
+// in the scope of first node in node-set. Empty prefix gives the default
+// namespace. It returns empty string, if the prefix is not bound or the
+// node is not an element.
+type namespaceURIForPrefix struct {
+	prefix Expr
+	arg    Expr
+}
+
+func (*namespaceURIForPrefix) Returns() DataType {
+	return String
+}
+
+func (e *namespaceURIForPrefix) Eval(ctx *Context) interface{} {
+	prefix := e.prefix.Eval(ctx).(string)
+	ns := nodeSet(e.arg.Eval(ctx))
+	if len(ns) > 0 {
+		iter := NamespaceAxis(ns[0])
+		for n := iter.Next(); n != nil; n = iter.Next() {
+			if n := n.(*dom.NameSpace); n.Prefix == prefix {
+				return n.URI
+			}
+		}
+	}
+	return ""
+}
+
+/************************************************************************/
+
+// sortFunc sorts the nodes by the string-value of key expression,
+// evaluated with each node as context node. The key expression must
+// be a literal string, which is compiled with the same Compiler.
+//
+// dataType 'number' compares the keys as numbers, with NaN before all
+// numbers; otherwise the keys are compared as text, using the collation.
+// order 'descending' reverses the order; otherwise it is ascending. The
+// sort is stable, i.e. nodes with equal keys stay in document order.
+//
+// Note that location path steps and union order their result in
+// document order. So the sorted order is seen only by consumers
+// of the result, like *XPath.EvalNodeSet and *XPath.EvalEach, and
+// by conversions and functions that use the first node of the
+// node-set, like string, number and name. Unlike xpath 1.0, they use
+// the first node in sorted order.
+type sortFunc struct {
+	ns        Expr
+	keyStr    Expr
+	dataType  Expr
+	order     Expr
+	key       Expr
+	collation Collation
+}
+
+func (*sortFunc) Returns() DataType {
+	return NodeSet
+}
+
+func (e *sortFunc) Eval(ctx *Context) interface{} {
+	ns := append([]dom.Node(nil), nodeSet(e.ns.Eval(ctx))...)
+	order(ns, ctx)
+	numeric := e.dataType != nil && e.dataType.Eval(ctx).(string) == "number"
+	descending := e.order != nil && e.order.Eval(ctx).(string) == "descending"
+
+	keys := make([]string, len(ns))
+	for i, n := range ns {
+		kctx := ctx.push(n, i+1, len(ns))
+		keys[i] = e.key.Eval(kctx).(string)
+		releaseContext(kctx)
+	}
+	var cmp func(i, j int) int
+	if numeric {
+		nums := make([]float64, len(keys))
+		for i, k := range keys {
+			nums[i] = Value2Number(k)
+		}
+		cmp = func(i, j int) int {
+			switch x, y := nums[i], nums[j]; {
+			case x < y || math.IsNaN(x) && !math.IsNaN(y):
+				return -1
+			case x > y || !math.IsNaN(x) && math.IsNaN(y):
+				return 1
+			}
+			return 0
+		}
+	} else if e.collation != nil {
+		cmp = func(i, j int) int {
+			return e.collation.Compare(keys[i], keys[j])
+		}
+	} else {
+		cmp = func(i, j int) int {
+			return strings.Compare(keys[i], keys[j])
+		}
+	}
+
+	index := make([]int, len(ns))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(i, j int) bool {
+		if descending {
+			return cmp(index[i], index[j]) > 0
+		}
+		return cmp(index[i], index[j]) < 0
+	})
+	r := make([]dom.Node, len(ns))
+	for i, j := range index {
+		r[i] = ns[j]
+	}
+	return r
+}
+
+func (e *sortFunc) configure(c *Compiler, depth int) Expr {
+	key, ok := Simplify(e.keyStr).(stringVal)
+	if !ok {
+		panic(LiteralArgError(ClarkName(ExtensionNS, "sort")))
+	}
+	if c.MaxDepth > 0 && depth+nesting(string(key)) > c.MaxDepth {
+		panic(TooDeepError(c.MaxDepth))
+	}
+	expr, err := xpath.Parse(string(key))
+	if err != nil {
+		panic(err)
+	}
+	e.key = asString(c.compile(expr, depth+1))
+	if !c.NoSimplify {
+		e.key = Simplify(e.key)
+	}
+	e.collation = c.Collation
+	return e
+}
+
+/************************************************************************/
+
+// trimAffix returns the string without the leading prefix or
+// trailing suffix. The string is returned unchanged, if it does
+// not begin with prefix or end with suffix.
+type trimAffix struct {
+	str    Expr
+	affix  Expr
+	suffix bool
+}
+
+func (*trimAffix) Returns() DataType {
+	return String
+}
+
+func (e *trimAffix) Eval(ctx *Context) interface{} {
+	str, affix := e.str.Eval(ctx).(string), e.affix.Eval(ctx).(string)
+	if e.suffix {
+		return strings.TrimSuffix(str, affix)
+	}
+	return strings.TrimPrefix(str, affix)
+}
+
+func (e *trimAffix) Simplify() Expr {
+	e.str, e.affix = Simplify(e.str), Simplify(e.affix)
+	if Literals(e.str, e.affix) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// matchCI is the case-insensitive variant of starts-with, ends-with
+// and contains. It uses CaseInsensitive collation, irrespective of
+// Compiler.Collation.
+type matchCI struct {
+	str   Expr
+	arg   Expr
+	match func(s, arg string) bool
+}
+
+func (*matchCI) Returns() DataType {
+	return Boolean
+}
+
+func (e *matchCI) Eval(ctx *Context) interface{} {
+	return e.match(e.str.Eval(ctx).(string), e.arg.Eval(ctx).(string))
+}
+
+func (e *matchCI) Simplify() Expr {
+	e.str, e.arg = Simplify(e.str), Simplify(e.arg)
+	if Literals(e.str, e.arg) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// replaceFirst replaces the first match of the regular expression
+// in the string with the replacement. The replacement is used
+// literally, i.e. $ is not expanded. The string is returned unchanged,
+// if there is no match.
+type replaceFirst struct {
+	str     Expr
+	pattern Expr
+	rep     Expr
+	re      *regexp.Regexp
+}
+
+func (*replaceFirst) Returns() DataType {
+	return String
+}
+
+func (e *replaceFirst) Eval(ctx *Context) interface{} {
+	re := evalRegexp(e.re, e.pattern, ctx)
+	rep := e.rep.Eval(ctx).(string)
+	done := false
+	return re.ReplaceAllStringFunc(e.str.Eval(ctx).(string), func(m string) string {
+		if done {
+			return m
+		}
+		done = true
+		return rep
+	})
+}
+
+func (e *replaceFirst) Simplify() Expr {
+	e.str, e.pattern, e.rep = Simplify(e.str), Simplify(e.pattern), Simplify(e.rep)
+	if Literals(e.pattern) {
+		e.re = compileRegexp(e.pattern.Eval(nil).(string))
+		if Literals(e.str, e.rep) {
+			return Value2Expr(e.Eval(nil))
+		}
+	}
+	return e
+}
+
+/************************************************************************/
+
+// matchCount returns the number of non-overlapping matches
+// of the regular expression in the string.
+type matchCount struct {
+	str     Expr
+	pattern Expr
+	re      *regexp.Regexp
+}
+
+func (*matchCount) Returns() DataType {
+	return Number
+}
+
+func (e *matchCount) Eval(ctx *Context) interface{} {
+	re := evalRegexp(e.re, e.pattern, ctx)
+	return float64(len(re.FindAllStringIndex(e.str.Eval(ctx).(string), -1)))
+}
+
+func (e *matchCount) Simplify() Expr {
+	e.str, e.pattern = Simplify(e.str), Simplify(e.pattern)
+	if Literals(e.pattern) {
+		e.re = compileRegexp(e.pattern.Eval(nil).(string))
+		if Literals(e.str) {
+			return Value2Expr(e.Eval(nil))
+		}
+	}
+	return e
+}
+
+/************************************************************************/
+
+// nodePathFunc returns the NodePath of first node in node-set.
+// It returns empty string, if the node-set is empty.
+type nodePathFunc struct {
+	arg Expr
+}
+
+func (*nodePathFunc) Returns() DataType {
+	return String
+}
+
+func (e *nodePathFunc) Eval(ctx *Context) interface{} {
+	ns := nodeSet(e.arg.Eval(ctx))
+	if len(ns) == 0 {
+		return ""
+	}
+	return NodePath(ns[0])
+}
+
+/************************************************************************/
+
+// normalizeSpaceUnicode is same as normalize-space, but treats
+// all unicode whitespace as space, like U+00A0 no-break space
+// and U+3000 ideographic space. Note that xpath 1.0 considers
+// only space, tab, carriage return and line feed as whitespace.
+type normalizeSpaceUnicode struct {
+	arg Expr
+}
+
+func (*normalizeSpaceUnicode) Returns() DataType {
+	return String
+}
+
+func (e *normalizeSpaceUnicode) Eval(ctx *Context) interface{} {
+	return strings.Join(strings.Fields(e.arg.Eval(ctx).(string)), " ")
+}
+
+func (e *normalizeSpaceUnicode) Simplify() Expr {
+	e.arg = Simplify(e.arg)
+	if Literals(e.arg) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// isDescendant tells whether the first node of node is a descendant of
+// the first node of ancestor, i.e. ancestor is on the ancestor axis of
+// node. So attribute and namespace nodes are descendants of their element.
+// A node is not its own descendant. It returns false, if either node-set
+// is empty.
+type isDescendant struct {
+	node     Expr
+	ancestor Expr
+}
+
+func (*isDescendant) Returns() DataType {
+	return Boolean
+}
+
+func (e *isDescendant) Eval(ctx *Context) interface{} {
+	ns1, ns2 := nodeSet(e.node.Eval(ctx)), nodeSet(e.ancestor.Eval(ctx))
+	if len(ns1) == 0 || len(ns2) == 0 {
+		return false
+	}
+	for n := Parent(ns1[0]); n != nil; n = Parent(n) {
+		if n == ns2[0] {
+			return true
+		}
+	}
+	return false
+}
+
+/************************************************************************/
+
+// adjacentText returns the concatenation of text nodes on the following
+// or preceding axis of the first node in node-set, in document order.
+// It returns empty string, if the node-set is empty.
+type adjacentText struct {
+	arg       Expr
+	preceding bool
+}
+
+func (*adjacentText) Returns() DataType {
+	return String
+}
+
+func (e *adjacentText) Eval(ctx *Context) interface{} {
+	ns := nodeSet(e.arg.Eval(ctx))
+	if len(ns) == 0 {
+		return ""
+	}
+	var texts []string
+	iter := FollowingAxis(ns[0])
+	if e.preceding {
+		iter = PrecedingAxis(ns[0])
+	}
+	for n := iter.Next(); n != nil; n = iter.Next() {
+		if n, ok := n.(*dom.Text); ok {
+			texts = append(texts, n.Data)
+		}
+	}
+	if e.preceding {
+		for i, j := 0, len(texts)-1; i < j; i, j = i+1, j-1 {
+			texts[i], texts[j] = texts[j], texts[i]
+		}
+	}
+	return strings.Join(texts, "")
+}
+
+/************************************************************************/
+
+// outerPosition returns the context position, the given number of
+// predicates out. Zero gives the position(). One gives the position
+// of context node in the predicate, that contains the current
+// predicate, and so on. It returns NaN, if there are not that many
+// predicates enclosing.
+//
+// For example in a[b[ext:position(1) = 2]], ext:position(1) is the
+// position of a, when testing the predicate on b.
+type outerPosition struct {
+	n Expr
+}
+
+func (*outerPosition) Returns() DataType {
+	return Number
+}
+
+func (e *outerPosition) Eval(ctx *Context) interface{} {
+	n := e.n.Eval(ctx).(float64)
+	if n < 0 || n != math.Trunc(n) {
+		return math.NaN()
+	}
+	for ; n > 0 && ctx != nil; n-- {
+		ctx = ctx.outer
+	}
+	if ctx == nil {
+		return math.NaN()
+	}
+	return float64(ctx.Pos)
+}
+
+/************************************************************************/
+
+// isName tells whether the string is an NCName, or a QName if qname
+// is set, as defined by the XML Namespaces recommendation. A QName
+// is either an NCName, or two NCNames separated by a single colon.
+type isName struct {
+	arg   Expr
+	qname bool
+}
+
+func (*isName) Returns() DataType {
+	return Boolean
+}
+
+func (e *isName) Eval(ctx *Context) interface{} {
+	s := e.arg.Eval(ctx).(string)
+	if e.qname {
+		if i := strings.IndexByte(s, ':'); i != -1 {
+			return isNCName(s[:i]) && isNCName(s[i+1:])
+		}
+	}
+	return isNCName(s)
+}
+
+func (e *isName) Simplify() Expr {
+	e.arg = Simplify(e.arg)
+	if Literals(e.arg) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+// isNCName tells whether s matches the NCName production,
+// i.e. an XML Name without colons.
+func isNCName(s string) bool {
+	if s == "" || !utf8.ValidString(s) {
+		return false
+	}
+	for i, r := range s {
+		if !isNameStartChar(r) && (i == 0 || !isNameChar(r)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNameStartChar tells whether r matches the NameStartChar
+// production of XML 1.0, excluding colon.
+func isNameStartChar(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', r == '_':
+		return true
+	case r < 0xC0:
+		return false
+	}
+	return r <= 0xD6 || 0xD8 <= r && r <= 0xF6 || 0xF8 <= r && r <= 0x2FF ||
+		0x370 <= r && r <= 0x37D || 0x37F <= r && r <= 0x1FFF ||
+		0x200C <= r && r <= 0x200D || 0x2070 <= r && r <= 0x218F ||
+		0x2C00 <= r && r <= 0x2FEF || 0x3001 <= r && r <= 0xD7FF ||
+		0xF900 <= r && r <= 0xFDCF || 0xFDF0 <= r && r <= 0xFFFD ||
+		0x10000 <= r && r <= 0xEFFFF
+}
+
+// isNameChar tells whether r matches the NameChar production
+// of XML 1.0, excluding colon and NameStartChar.
+func isNameChar(r rune) bool {
+	return '0' <= r && r <= '9' || r == '-' || r == '.' || r == 0xB7 ||
+		0x300 <= r && r <= 0x36F || 0x203F <= r && r <= 0x2040
+}
+
+/************************************************************************/
+
+// roundSig rounds the number to given number of significant digits.
+// If the number is midway between two values, it is rounded away from
+// zero. It returns NaN, if digits is less than one.
+type roundSig struct {
+	num    Expr
+	digits Expr
+}
+
+func (*roundSig) Returns() DataType {
+	return Number
+}
+
+func (e *roundSig) Eval(ctx *Context) interface{} {
+	num := e.num.Eval(ctx).(float64)
+	digits := math.Floor(e.digits.Eval(ctx).(float64) + 0.5)
+	switch {
+	case math.IsNaN(digits) || digits < 1:
+		return math.NaN()
+	case math.IsNaN(num) || math.IsInf(num, 0) || num == 0 || digits > 17:
+		// float64 has no more than 17 significant digits.
+		return num
+	}
+	// log10 can be off by one near powers of ten.
+	mag := int(math.Floor(math.Log10(math.Abs(num))))
+	if math.Abs(num) < math.Pow10(mag) {
+		mag--
+	} else if math.Abs(num) >= math.Pow10(mag+1) {
+		mag++
+	}
+	switch exp := int(digits) - 1 - mag; {
+	case exp < -22 || exp > 22:
+		// 10^exp is not exact, so scaling loses precision.
+		// strconv rounds on the exact decimal value instead.
+		f, _ := strconv.ParseFloat(strconv.FormatFloat(num, 'e', int(digits)-1, 64), 64)
+		return f
+	case exp < 0:
+		scale := math.Pow10(-exp)
+		return math.Round(num/scale) * scale
+	default:
+		scale := math.Pow10(exp)
+		return math.Round(num*scale) / scale
+	}
+}
+
+func (e *roundSig) Simplify() Expr {
+	e.num, e.digits = Simplify(e.num), Simplify(e.digits)
+	if Literals(e.num, e.digits) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// distinctNames returns the first element, in document order, for each
+// distinct expanded-name of elements in node-set. Nodes other than
+// elements are ignored.
+type distinctNames struct {
+	arg Expr
+}
+
+func (*distinctNames) Returns() DataType {
+	return NodeSet
+}
+
+func (e *distinctNames) Eval(ctx *Context) interface{} {
+	ns := append([]dom.Node(nil), nodeSet(e.arg.Eval(ctx))...)
+	order(ns, ctx)
+	seen := make(map[string]struct{})
+	var r []dom.Node
+	for _, n := range ns {
+		if elem, ok := n.(*dom.Element); ok {
+			name := ClarkName(elem.URI, elem.Local)
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				r = append(r, n)
+			}
+		}
+	}
+	return r
+}
+
+/************************************************************************/
+
+// indexOf returns the 1-based position of the first node of node in
+// node-set, in document order. It returns 0, if node is empty, or its
+// first node is not in node-set.
+type indexOf struct {
+	ns   Expr
+	node Expr
+}
+
+func (*indexOf) Returns() DataType {
+	return Number
+}
+
+func (e *indexOf) Eval(ctx *Context) interface{} {
+	node := nodeSet(e.node.Eval(ctx))
+	if len(node) == 0 {
+		return float64(0)
+	}
+	ns := append([]dom.Node(nil), nodeSet(e.ns.Eval(ctx))...)
+	order(ns, ctx)
+	for i, n := range ns {
+		if n == node[0] {
+			return float64(i + 1)
+		}
+	}
+	return float64(0)
+}
+
+/************************************************************************/
+
+// rootFunc returns the root of the tree containing the first node of
+// node-set, i.e. its topmost ancestor-or-self. This is the document node,
+// unless the node is detached from the document. It returns empty node-set,
+// if node-set is empty.
+//
+// If the node-set is not given, it is same as absolute location path /,
+// i.e. it returns Context.Root, if set, otherwise the root of context node.
+type rootFunc struct {
+	arg Expr
+}
+
+func (*rootFunc) Returns() DataType {
+	return NodeSet
+}
+
+func (e *rootFunc) Eval(ctx *Context) interface{} {
+	var n dom.Node
+	if e.arg == nil {
+		if ctx.Root != nil {
+			return []dom.Node{ctx.Root}
+		}
+		n = ctx.Node
+	} else if ns := nodeSet(e.arg.Eval(ctx)); len(ns) > 0 {
+		n = ns[0]
+	} else {
+		return []dom.Node(nil)
+	}
+	return []dom.Node{root(n)}
+}
+
+/************************************************************************/
+
+// rangeFunc returns a text node for each integer from start to end
+// inclusive, in ascending order. The text nodes are synthesized, like
+// the nodes of other functions returning sequence. The start and
+// end are rounded to integers. It returns empty node-set, if end is less
+// than start, or either is NaN. It panics with RangeSizeError, if there
+// are more integers than Compiler.MaxRangeSize.
+type rangeFunc struct {
+	start Expr
+	end   Expr
+	max   int
+}
+
+func (*rangeFunc) Returns() DataType {
+	return NodeSet
+}
+
+func (e *rangeFunc) Eval(ctx *Context) interface{} {
+	start := math.Floor(e.start.Eval(ctx).(float64) + 0.5)
+	end := math.Floor(e.end.Eval(ctx).(float64) + 0.5)
+	if math.IsNaN(start) || math.IsNaN(end) || end < start {
+		return []dom.Node(nil)
+	}
+	// infinite bounds give NaN, which must also fail
+	if !(end-start < float64(e.max)) {
+		panic(RangeSizeError(e.max))
+	}
+	values := make([]string, int(end-start)+1)
+	for i := range values {
+		values[i] = Value2String(start + float64(i))
+	}
+	return sequence(ctx, values)
+}
+
+func (e *rangeFunc) configure(c *Compiler, depth int) Expr {
+	e.max = c.MaxRangeSize
+	if e.max <= 0 {
+		e.max = 10000
+	}
+	return e
+}
+
+func (e *rangeFunc) Simplify() Expr {
+	e.start, e.end = Simplify(e.start), Simplify(e.end)
+	return e
+}
+
+/************************************************************************/
+
+// byteLength returns the number of bytes in utf-8 encoding of the string.
+// Unlike string-length, which counts characters as xpath 1.0 requires,
+// characters outside ascii are counted as two to four bytes. For example
+// byte-length('café') is 5, while string-length('café') is 4.
+type byteLength struct {
+	arg Expr
+}
+
+func (*byteLength) Returns() DataType {
+	return Number
+}
+
+func (e *byteLength) Eval(ctx *Context) interface{} {
+	return float64(len(e.arg.Eval(ctx).(string)))
+}
+
+func (e *byteLength) Simplify() Expr {
+	e.arg = Simplify(e.arg)
+	if Literals(e.arg) {
+		return Value2Expr(e.Eval(nil))
+	}
+	return e
+}
+
+/************************************************************************/
+
+// distinctCount returns the number of distinct string-values of nodes
+// in node-set. The string-values are compared as is, without any
+// normalization, so 'a' and ' a' are counted as distinct.
+type distinctCount struct {
+	arg Expr
+}
+
+func (*distinctCount) Returns() DataType {
+	return Number
+}
+
+func (e *distinctCount) Eval(ctx *Context) interface{} {
+	seen := make(map[string]struct{})
+	for _, n := range nodeSet(e.arg.Eval(ctx)) {
+		seen[Node2String(n)] = struct{}{}
+	}
+	return float64(len(seen))
+}
+
+/************************************************************************/
+
+// ancestorNamed returns the nearest ancestor element of the node, with
+// given name. If ns is nil, the context node is used. An unprefixed name
+// matches elements with that local name in any namespace, while prefix
+// is resolved using compiler's Namespaces. The name is resolved at
+// compile time, so it must be literal.
+type ancestorNamed struct {
+	name Expr
+	ns   Expr
+
+	anyURI     bool
+	uri, local string
+}
+
+func (*ancestorNamed) Returns() DataType {
+	return NodeSet
+}
+
+func (e *ancestorNamed) Eval(ctx *Context) interface{} {
+	n := ctx.Node
+	if e.ns != nil {
+		ns := nodeSet(e.ns.Eval(ctx))
+		if len(ns) == 0 {
+			return []dom.Node(nil)
+		}
+		n = ns[0]
+	}
+	for n = Parent(n); n != nil; n = n.Parent() {
+		elem, ok := n.(*dom.Element)
+		if !ok {
+			break
+		}
+		if elem.Local == e.local && (e.anyURI || elem.URI == e.uri) {
+			return []dom.Node{elem}
+		}
+	}
+	return []dom.Node(nil)
+}
+
+func (e *ancestorNamed) configure(c *Compiler, depth int) Expr {
+	name, ok := Simplify(e.name).(stringVal)
+	if !ok {
+		panic(LiteralArgError(ClarkName(ExtensionNS, "ancestor-named")))
+	}
+	prefix, local := "", string(name)
+	if colon := strings.IndexByte(local, ':'); colon != -1 {
+		prefix, local = local[:colon], local[colon+1:]
+	}
+	e.anyURI, e.uri, e.local = prefix == "", c.resolvePrefix(prefix), local
+	return e
+}
+
+/************************************************************************/
+
+// areSiblings tells whether the first nodes of both node-sets are
+// distinct children of same parent. It returns false, if any node-set
+// is empty, or any node is attribute or namespace. A node is not its own
+// sibling, as with following-sibling and preceding-sibling axes.
+type areSiblings struct {
+	ns1 Expr
+	ns2 Expr
+}
+
+func (*areSiblings) Returns() DataType {
+	return Boolean
+}
+
+func (e *areSiblings) Eval(ctx *Context) interface{} {
+	ns1 := nodeSet(e.ns1.Eval(ctx))
+	if len(ns1) == 0 {
+		return false
+	}
+	ns2 := nodeSet(e.ns2.Eval(ctx))
+	if len(ns2) == 0 {
+		return false
+	}
+	n1, n2 := ns1[0], ns2[0]
+	if n1 == n2 || !isChild(n1) || !isChild(n2) {
+		return false
+	}
+	p := n1.Parent()
+	return p != nil && p == n2.Parent()
+}
+
+/************************************************************************/
+
+// owner returns the element owning the first node of node-set, if it is
+// attribute or namespace node. For other nodes, it returns the parent.
+// It returns empty node-set, if node-set is empty, or the node has no
+// parent.
+type owner struct {
+	arg Expr
+}
+
+func (*owner) Returns() DataType {
+	return NodeSet
+}
+
+func (e *owner) Eval(ctx *Context) interface{} {
+	ns := nodeSet(e.arg.Eval(ctx))
+	if len(ns) == 0 {
+		return []dom.Node(nil)
+	}
+	if p := Parent(ns[0]); p != nil {
+		return []dom.Node{p}
+	}
+	return []dom.Node(nil)
+}
+
+/************************************************************************/
+
+// evalRegexp returns re, if it is not nil. Otherwise it
+// compiles the pattern evaluated in the context.
+func evalRegexp(re *regexp.Regexp, pattern Expr, ctx *Context) *regexp.Regexp {
+	if re != nil {
+		return re
+	}
+	return compileRegexp(pattern.Eval(ctx).(string))
+}
+
+// compileRegexp compiles the regular expression. It panics
+// with the syntax error, if the pattern is not valid.
+func compileRegexp(pattern string) *regexp.Regexp {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
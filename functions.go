@@ -106,14 +106,30 @@ func CompileFunc(impl func(args []interface{}) interface{}) func(f *Function, ar
 	}
 }
 
+// CompileTypedFunc is same as CompileFunc, but the compiled expression
+// returns the given DataType, rather than Function.Returns. So Returns
+// can be left unspecified:
+//
+//	&Function{
+//		Args:    Args{Mandatory(String)},
+//		Compile: CompileTypedFunc(Number, impl),
+//	}
+//
+// Use Compiler.StrictFunctions to verify that impl returns values of ret type.
+func CompileTypedFunc(ret DataType, impl func(args []interface{}) interface{}) func(f *Function, args []Expr) Expr {
+	return func(f *Function, args []Expr) Expr {
+		return &funcCall{args, ret, impl}
+	}
+}
+
 var coreFunctions = map[string]*Function{
 	"string": {
 		String, Args{Optional(Any)},
 		func(f *Function, args []Expr) Expr {
 			if len(args) == 0 {
-				return &stringFunc{ContextExpr{}}
+				return &stringFunc{arg: ContextExpr{}}
 			}
-			return &stringFunc{args[0]}
+			return &stringFunc{arg: args[0]}
 		}},
 	"number": {
 		Number, Args{Optional(Any)},
@@ -206,17 +222,17 @@ var coreFunctions = map[string]*Function{
 	"starts-with": {
 		Boolean, Args{Mandatory(String), Mandatory(String)},
 		func(f *Function, args []Expr) Expr {
-			return &startsWith{args[0], args[1]}
+			return &startsWith{args[0], args[1], nil}
 		}},
 	"ends-with": {
 		Boolean, Args{Mandatory(String), Mandatory(String)},
 		func(f *Function, args []Expr) Expr {
-			return &endsWith{args[0], args[1]}
+			return &endsWith{args[0], args[1], nil}
 		}},
 	"contains": {
 		Boolean, Args{Mandatory(String), Mandatory(String)},
 		func(f *Function, args []Expr) Expr {
-			return &contains{args[0], args[1]}
+			return &contains{args[0], args[1], nil}
 		}},
 	"concat": {
 		String, Args{Mandatory(String), Mandatory(String), Variadic(String)},
@@ -226,7 +242,7 @@ var coreFunctions = map[string]*Function{
 	"translate": {
 		String, Args{Mandatory(String), Mandatory(String), Mandatory(String)},
 		func(f *Function, args []Expr) Expr {
-			return &translate{args[0], args[1], args[2]}
+			return &translate{args[0], args[1], args[2], nil}
 		}},
 	"substring": {
 		String, Args{Mandatory(String), Mandatory(Number), Optional(Number)},
@@ -264,7 +280,7 @@ var coreFunctions = map[string]*Function{
 	"lang": {
 		Boolean, Args{Mandatory(String)},
 		func(f *Function, args []Expr) Expr {
-			return &lang{args[0]}
+			return &lang{args[0], ""}
 		}},
 }
 
@@ -279,7 +295,7 @@ func (*numberFunc) Returns() DataType {
 }
 
 func (e *numberFunc) Eval(ctx *Context) interface{} {
-	return Value2Number(e.arg.Eval(ctx))
+	return ctx.value2Number(e.arg.Eval(ctx))
 }
 
 func (e *numberFunc) Simplify() Expr {
@@ -301,6 +317,9 @@ func (*booleanFunc) Returns() DataType {
 }
 
 func (e *booleanFunc) Eval(ctx *Context) interface{} {
+	if arg, ok := e.arg.(existential); ok {
+		return arg.exists(ctx)
+	}
 	return Value2Boolean(e.arg.Eval(ctx))
 }
 
@@ -316,6 +335,10 @@ func (e *booleanFunc) Simplify() Expr {
 
 type stringFunc struct {
 	arg Expr
+
+	// booleanStrings is the Compiler.BooleanStrings,
+	// used to fold boolean literal.
+	booleanStrings [2]string
 }
 
 func (*stringFunc) Returns() DataType {
@@ -323,13 +346,19 @@ func (*stringFunc) Returns() DataType {
 }
 
 func (e *stringFunc) Eval(ctx *Context) interface{} {
-	return Value2String(e.arg.Eval(ctx))
+	return ctx.value2String(e.arg.Eval(ctx))
+}
+
+func (e *stringFunc) configure(c *Compiler, depth int) Expr {
+	e.booleanStrings = c.BooleanStrings
+	return e
 }
 
 func (e *stringFunc) Simplify() Expr {
 	e.arg = Simplify(e.arg)
 	if Literals(e.arg) {
-		return Value2Expr(e.Eval(nil))
+		o := evalOptions{booleanStrings: e.booleanStrings}
+		return stringVal(o.value2String(e.arg.Eval(nil)))
 	}
 	return e
 }
@@ -369,7 +398,7 @@ func (*count) Returns() DataType {
 }
 
 func (e *count) Eval(ctx *Context) interface{} {
-	return float64(len(e.arg.Eval(ctx).([]dom.Node)))
+	return float64(len(nodeSet(e.arg.Eval(ctx))))
 }
 
 /************************************************************************/
@@ -384,8 +413,8 @@ func (*sum) Returns() DataType {
 
 func (e *sum) Eval(ctx *Context) interface{} {
 	var r float64
-	for _, n := range e.arg.Eval(ctx).([]dom.Node) {
-		r += Node2Number(n)
+	for _, n := range nodeSet(e.arg.Eval(ctx)) {
+		r += ctx.node2Number(n)
 	}
 	return r
 }
@@ -401,7 +430,7 @@ func (*localName) Returns() DataType {
 }
 
 func (e *localName) Eval(ctx *Context) interface{} {
-	ns := e.arg.Eval(ctx).([]dom.Node)
+	ns := nodeSet(e.arg.Eval(ctx))
 	if len(ns) > 0 {
 		switch n := ns[0].(type) {
 		case *dom.Element:
@@ -427,8 +456,14 @@ func (*namespaceURI) Returns() DataType {
 	return String
 }
 
+// Eval returns the namespace uri of first node in document order.
+// Only elements and attributes have namespace uri, it is empty for
+// other nodes including namespace nodes.
+//
+// Node-sets computed by the engine are always in document order,
+// so the first node is taken as is.
 func (e *namespaceURI) Eval(ctx *Context) interface{} {
-	ns := e.arg.Eval(ctx).([]dom.Node)
+	ns := nodeSet(e.arg.Eval(ctx))
 	if len(ns) > 0 {
 		switch n := ns[0].(type) {
 		case *dom.Element:
@@ -451,7 +486,7 @@ func (*qname) Returns() DataType {
 }
 
 func (e *qname) Eval(ctx *Context) interface{} {
-	ns := e.arg.Eval(ctx).([]dom.Node)
+	ns := nodeSet(e.arg.Eval(ctx))
 	if len(ns) > 0 {
 		switch n := ns[0].(type) {
 		case *dom.Element:
@@ -523,8 +558,9 @@ func isSpace(b byte) bool {
 /************************************************************************/
 
 type startsWith struct {
-	str    Expr
-	prefix Expr
+	str       Expr
+	prefix    Expr
+	collation Collation
 }
 
 func (*startsWith) Returns() DataType {
@@ -532,7 +568,16 @@ func (*startsWith) Returns() DataType {
 }
 
 func (e *startsWith) Eval(ctx *Context) interface{} {
-	return strings.HasPrefix(e.str.Eval(ctx).(string), e.prefix.Eval(ctx).(string))
+	str, prefix := e.str.Eval(ctx).(string), e.prefix.Eval(ctx).(string)
+	if e.collation != nil {
+		return e.collation.HasPrefix(str, prefix)
+	}
+	return strings.HasPrefix(str, prefix)
+}
+
+func (e *startsWith) configure(c *Compiler, depth int) Expr {
+	e.collation = c.Collation
+	return e
 }
 
 func (e *startsWith) Simplify() Expr {
@@ -546,8 +591,9 @@ func (e *startsWith) Simplify() Expr {
 /************************************************************************/
 
 type endsWith struct {
-	str    Expr
-	suffix Expr
+	str       Expr
+	suffix    Expr
+	collation Collation
 }
 
 func (*endsWith) Returns() DataType {
@@ -555,7 +601,16 @@ func (*endsWith) Returns() DataType {
 }
 
 func (e *endsWith) Eval(ctx *Context) interface{} {
-	return strings.HasSuffix(e.str.Eval(ctx).(string), e.suffix.Eval(ctx).(string))
+	str, suffix := e.str.Eval(ctx).(string), e.suffix.Eval(ctx).(string)
+	if e.collation != nil {
+		return e.collation.HasSuffix(str, suffix)
+	}
+	return strings.HasSuffix(str, suffix)
+}
+
+func (e *endsWith) configure(c *Compiler, depth int) Expr {
+	e.collation = c.Collation
+	return e
 }
 
 func (e *endsWith) Simplify() Expr {
@@ -569,8 +624,9 @@ func (e *endsWith) Simplify() Expr {
 /************************************************************************/
 
 type contains struct {
-	str    Expr
-	substr Expr
+	str       Expr
+	substr    Expr
+	collation Collation
 }
 
 func (*contains) Returns() DataType {
@@ -578,7 +634,16 @@ func (*contains) Returns() DataType {
 }
 
 func (e *contains) Eval(ctx *Context) interface{} {
-	return strings.Contains(e.str.Eval(ctx).(string), e.substr.Eval(ctx).(string))
+	str, substr := e.str.Eval(ctx).(string), e.substr.Eval(ctx).(string)
+	if e.collation != nil {
+		return e.collation.Contains(str, substr)
+	}
+	return strings.Contains(str, substr)
+}
+
+func (e *contains) configure(c *Compiler, depth int) Expr {
+	e.collation = c.Collation
+	return e
 }
 
 func (e *contains) Simplify() Expr {
@@ -641,10 +706,13 @@ func (e *concat) Simplify() Expr {
 
 /************************************************************************/
 
+// translate replaces characters in str. If from and to
+// are literals, mapping is computed once by Simplify.
 type translate struct {
-	str  Expr
-	from Expr
-	to   Expr
+	str     Expr
+	from    Expr
+	to      Expr
+	mapping map[rune]rune
 }
 
 func (*translate) Returns() DataType {
@@ -652,47 +720,49 @@ func (*translate) Returns() DataType {
 }
 
 func (e *translate) Eval(ctx *Context) interface{} {
-	from := []rune(e.from.Eval(ctx).(string))
-	to := []rune(e.to.Eval(ctx).(string))
-	replace := make(map[rune]rune)
-	remove := make(map[rune]struct{})
-	for i, frune := range from {
-		if _, ok := replace[frune]; ok {
-			continue
-		}
-		if _, ok := remove[frune]; ok {
-			continue
-		}
-		if i < len(to) {
-			replace[frune] = to[i]
-		} else {
-			remove[frune] = struct{}{}
-		}
+	mapping := e.mapping
+	if mapping == nil {
+		mapping = translateMapping(e.from.Eval(ctx).(string), e.to.Eval(ctx).(string))
 	}
-
-	str := e.str.Eval(ctx).(string)
-	buf := bytes.NewBuffer(make([]byte, 0, len(str)))
-	for _, r := range str {
-		if _, ok := remove[r]; ok {
-			continue
+	return strings.Map(func(r rune) rune {
+		if v, ok := mapping[r]; ok {
+			return v
 		}
-		if v, ok := replace[r]; ok {
-			buf.WriteRune(v)
-		} else {
-			buf.WriteRune(r)
-		}
-	}
-	return buf.String()
+		return r
+	}, e.str.Eval(ctx).(string))
 }
 
 func (e *translate) Simplify() Expr {
 	e.str, e.from, e.to = Simplify(e.str), Simplify(e.from), Simplify(e.to)
-	if Literals(e.str, e.from, e.to) {
-		return Value2Expr(e.Eval(nil))
+	if Literals(e.from, e.to) {
+		e.mapping = translateMapping(e.from.Eval(nil).(string), e.to.Eval(nil).(string))
+		if Literals(e.str) {
+			return Value2Expr(e.Eval(nil))
+		}
 	}
 	return e
 }
 
+// translateMapping returns the mapping of characters in from to
+// the characters at the same position in to. The characters
+// which are to be removed are mapped to -1.
+func translateMapping(from, to string) map[rune]rune {
+	toRunes := []rune(to)
+	mapping := make(map[rune]rune)
+	i := 0
+	for _, r := range from {
+		if _, ok := mapping[r]; !ok {
+			if i < len(toRunes) {
+				mapping[r] = toRunes[i]
+			} else {
+				mapping[r] = -1
+			}
+		}
+		i++
+	}
+	return mapping
+}
+
 /************************************************************************/
 
 type substringBefore struct {
@@ -852,7 +922,8 @@ func (e *not) Simplify() Expr {
 /************************************************************************/
 
 type lang struct {
-	lang Expr
+	lang        Expr
+	defaultLang string
 }
 
 func (*lang) Returns() DataType {
@@ -869,19 +940,29 @@ func (e *lang) Eval(ctx *Context) interface{} {
 		if elem, ok := n.(*dom.Element); ok {
 			attr := elem.GetAttr("http://www.w3.org/XML/1998/namespace", "lang")
 			if attr != nil {
-				sublang := attr.Value
-				if strings.EqualFold(sublang, lang) {
-					return true
-				}
-				ll := len(lang)
-				return len(sublang) > ll && sublang[ll] == '-' && strings.EqualFold(sublang[:ll], lang)
+				return langMatches(attr.Value, lang)
 			}
 		} else {
 			break
 		}
 		n = n.Parent()
 	}
-	return false
+	return e.defaultLang != "" && langMatches(e.defaultLang, lang)
+}
+
+func (e *lang) configure(c *Compiler, depth int) Expr {
+	e.defaultLang = c.DefaultLang
+	return e
+}
+
+// langMatches tells whether sublang is same as lang
+// or is a sublanguage of lang, ignoring case.
+func langMatches(sublang, lang string) bool {
+	if strings.EqualFold(sublang, lang) {
+		return true
+	}
+	ll := len(lang)
+	return len(sublang) > ll && sublang[ll] == '-' && strings.EqualFold(sublang[:ll], lang)
 }
 
 /************************************************************************/
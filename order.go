@@ -19,13 +19,47 @@ func reverse(ns []dom.Node) {
 		j--
 	}
 }
-func order(ns []dom.Node) {
+
+// order sorts the nodes in document order. The ctx tells the
+// relative order of attributes, and caches the positions of
+// child nodes for the current evaluation. It can be nil.
+func order(ns []dom.Node, ctx *Context) {
+	if len(ns) < 2 {
+		return
+	}
+	s := new(sorter)
+	if _, ok := root(ns[0]).(*dom.Document); !ok {
+		// detached nodes are ordered by their appearance in ns,
+		// which is permuted while sorting.
+		s.ns = append([]dom.Node(nil), ns...)
+	}
+	if ctx != nil && ctx.state != nil {
+		s.attrDocOrder = ctx.state.attrDocOrder
+		if ctx.state.index == nil {
+			ctx.state.index = make(map[dom.Node]int)
+		}
+		s.index = ctx.state.index
+	}
 	sort.Slice(ns, func(i, j int) bool {
-		return cmp(ns[i], ns[j]) < 0
+		return s.cmp(ns[i], ns[j]) < 0
 	})
 }
 
-func cmp(n1, n2 dom.Node) int {
+// sorter compares nodes in document order. It remembers
+// the position of the child nodes among their siblings, so
+// that the siblings are compared without scanning them.
+//
+// The nodes from different trees are ordered by the first appearance
+// of their tree in ns, if given. Otherwise the trees are in the order
+// they are first compared.
+type sorter struct {
+	ns           []dom.Node
+	index        map[dom.Node]int
+	roots        map[dom.Node]int
+	attrDocOrder bool
+}
+
+func (s *sorter) cmp(n1, n2 dom.Node) int {
 	if n1 == n2 {
 		return 0
 	}
@@ -41,9 +75,13 @@ func cmp(n1, n2 dom.Node) int {
 			if isNamespace(n2) {
 				return 1
 			}
-			return strings.Compare(n1.(*dom.Attr).Name.String(), n2.(*dom.Attr).Name.String())
+			a1, a2 := n1.(*dom.Attr), n2.(*dom.Attr)
+			if s.attrDocOrder {
+				return attrIndex(a1) - attrIndex(a2)
+			}
+			return strings.Compare(a1.Name.String(), a2.Name.String())
 		}
-		return cmp(p1, p2)
+		return s.cmp(p1, p2)
 	}
 
 	d1, d2 := depth(n1), depth(n2)
@@ -66,31 +104,83 @@ func cmp(n1, n2 dom.Node) int {
 	// a1 and a2 are now at same depth; and are not the same
 	for {
 		p1, p2 := Parent(a1), Parent(a2)
+		if p1 == nil {
+			return s.rootIndex(a1) - s.rootIndex(a2)
+		}
 		if p1 == p2 {
-			return cmpSiblings(a1, a2)
+			return s.cmpSiblings(a1, a2)
 		}
 		a1, a2 = p1, p2
 	}
 }
 
-func cmpSiblings(s1, s2 dom.Node) int {
+func (s *sorter) cmpSiblings(s1, s2 dom.Node) int {
 	// attributes and namespaces sort before child nodes
 	if !isChild(s1) {
-		return 1
+		return -1
 	} else if !isChild(s2) {
+		return 1
+	}
+	if s.indexOf(s1) < s.indexOf(s2) {
 		return -1
 	}
-	iter := FollowingSiblingAxis(s1)
-	for {
-		n := iter.Next()
-		if n == nil {
-			break
+	return 1
+}
+
+// indexOf returns the position of child node n among its siblings.
+func (s *sorter) indexOf(n dom.Node) int {
+	if i, ok := s.index[n]; ok {
+		return i
+	}
+	if s.index == nil {
+		s.index = make(map[dom.Node]int)
+	}
+	for i, c := range n.Parent().Children() {
+		s.index[c] = i
+	}
+	return s.index[n]
+}
+
+// rootIndex returns the position of the tree with root r,
+// among the trees of nodes being sorted.
+func (s *sorter) rootIndex(r dom.Node) int {
+	if s.roots == nil {
+		s.roots = make(map[dom.Node]int)
+		for _, n := range s.ns {
+			s.addRoot(root(n))
 		}
-		if n == s2 {
-			return -1
+	}
+	return s.addRoot(r)
+}
+
+// addRoot returns the position of tree with root r,
+// giving it the next position, if it is new.
+func (s *sorter) addRoot(r dom.Node) int {
+	i, ok := s.roots[r]
+	if !ok {
+		i = len(s.roots)
+		s.roots[r] = i
+	}
+	return i
+}
+
+// root returns the topmost ancestor-or-self of n.
+func root(n dom.Node) dom.Node {
+	for p := Parent(n); p != nil; p = Parent(p) {
+		n = p
+	}
+	return n
+}
+
+// attrIndex returns the position of attribute among
+// the attributes of its element.
+func attrIndex(a *dom.Attr) int {
+	for i, attr := range a.Owner.Attrs {
+		if attr == a {
+			return i
 		}
 	}
-	return 1
+	return -1
 }
 
 func isChild(n dom.Node) bool {
@@ -0,0 +1,361 @@
+// Copyright 2017 Santhosh Kumar Tekuri. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xpath
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/santhosh-tekuri/dom"
+	xpath "github.com/santhosh-tekuri/xpathparser"
+)
+
+// StreamingXPath is the representation of a compiled xpath, that is
+// evaluated against xml token stream, without building the document.
+// A StreamingXPath is safe for concurrent use by multiple goroutines.
+type StreamingXPath struct {
+	str   string
+	steps []*streamStep
+}
+
+type streamStep struct {
+	descendant bool
+	test       func(dom.Node) bool
+	predicates []*XPath
+}
+
+// CompileStreaming compiles given xpath 1.0 expression for evaluation
+// against xml token stream, so that documents larger than memory can
+// be queried.
+//
+// Only a subset of xpath is supported:
+//   - the expression must be an absolute location path
+//   - steps must use child or descendant axis, with an element name
+//     test like x, p:x, p:* or *. The abbreviation // is supported
+//   - predicates can only use the attributes of the element being
+//     tested, like [@id='x' and not(@deleted)]. So the predicates which
+//     need children, position() or last(), like [title], [.='x'] or
+//     [2] are not supported. Variables are not supported. Only core
+//     functions that do not need content of the element are supported,
+//     so string() is not, while string(@id) is
+//
+// It returns StreamingError, if the expression uses anything else.
+func (c *Compiler) CompileStreaming(str string) (x *StreamingXPath, err error) {
+	if c.MaxDepth > 0 && nesting(str) > c.MaxDepth {
+		return nil, TooDeepError(c.MaxDepth)
+	}
+	expr, err := xpath.Parse(str)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		panic2error(recover(), &err)
+	}()
+	lp, ok := expr.(*xpath.LocationPath)
+	if !ok || !lp.Abs || len(lp.Steps) == 0 {
+		panic(StreamingError("expression other than absolute location path"))
+	}
+	x = &StreamingXPath{str: str}
+	descendant := false
+	for _, s := range lp.Steps {
+		if s.Axis == xpath.DescendantOrSelf && s.NodeTest == xpath.Node && len(s.Predicates) == 0 {
+			// abbreviation //
+			descendant = true
+			continue
+		}
+		if s.Axis != xpath.Child && s.Axis != xpath.Descendant {
+			panic(StreamingError(fmt.Sprintf("%v axis", s.Axis)))
+		}
+		if _, ok := s.NodeTest.(*xpath.NameTest); !ok {
+			panic(StreamingError(fmt.Sprintf("node test %v", s.NodeTest)))
+		}
+		step := &streamStep{
+			descendant: descendant || s.Axis == xpath.Descendant,
+			test:       c.nodeTest(s.Axis, s.NodeTest),
+		}
+		for _, p := range s.Predicates {
+			checkStreamingPredicate(p)
+			px, err := c.CompileExpr(p)
+			if err != nil {
+				return nil, err
+			}
+			if px.Returns() == Number {
+				panic(StreamingError(fmt.Sprintf("positional predicate [%v]", p)))
+			}
+			step.predicates = append(step.predicates, px)
+		}
+		x.steps = append(x.steps, step)
+		descendant = false
+	}
+	if descendant {
+		panic(StreamingError("location path ending with //"))
+	}
+	return x, nil
+}
+
+// checkStreamingPredicate panics with StreamingError, if
+// the predicate uses anything other than attributes of
+// context node.
+func checkStreamingPredicate(e xpath.Expr) {
+	switch e := e.(type) {
+	case xpath.Number, xpath.String:
+		return
+	case *xpath.NegateExpr:
+		checkStreamingPredicate(e.Expr)
+		return
+	case *xpath.BinaryExpr:
+		checkStreamingPredicate(e.LHS)
+		checkStreamingPredicate(e.RHS)
+		return
+	case *xpath.LocationPath:
+		if !e.Abs && len(e.Steps) == 1 && e.Steps[0].Axis == xpath.Attribute && len(e.Steps[0].Predicates) == 0 {
+			return
+		}
+	case *xpath.FuncCall:
+		minArgs, ok := streamingFunctions[e.Local]
+		if !ok || e.Prefix != "" || len(e.Args) < minArgs {
+			panic(StreamingError(fmt.Sprintf("function %v", e)))
+		}
+		for _, arg := range e.Args {
+			checkStreamingPredicate(arg)
+		}
+		return
+	}
+	panic(StreamingError(fmt.Sprintf("%v in predicate", e)))
+}
+
+// streamingFunctions tells the core functions that can be used in
+// streaming predicates, with the number of arguments needed, so that
+// the context node is used only for its name. Other functions may
+// read the content or ancestors of context node, which are not known
+// when the start tag is read.
+var streamingFunctions = map[string]int{
+	"true":             0,
+	"false":            0,
+	"not":              1,
+	"boolean":          1,
+	"name":             0,
+	"local-name":       0,
+	"namespace-uri":    0,
+	"string":           1,
+	"concat":           2,
+	"starts-with":      2,
+	"contains":         2,
+	"substring-before": 2,
+	"substring-after":  2,
+	"substring":        2,
+	"string-length":    1,
+	"normalize-space":  1,
+	"translate":        3,
+	"number":           1,
+	"sum":              1,
+	"floor":            1,
+	"ceiling":          1,
+	"round":            1,
+	"count":            1,
+}
+
+// String returns the source xpath expression
+func (x *StreamingXPath) String() string {
+	return x.str
+}
+
+// Each reads xml document from r, and calls fn for each matching element,
+// as soon as its end tag is read. Iteration stops when fn returns false.
+//
+// The element passed to fn is complete, with all its descendants, but it is
+// detached from document, i.e. it has no parent. A matching element within
+// another matching element is an exception: it is passed before the enclosing
+// element, and is left as a child of it.
+//
+// Only the matching elements are kept in memory. So fn should not
+// retain the elements, it does not need.
+func (x *StreamingXPath) Each(r io.Reader, fn func(*dom.Element) bool) error {
+	type entry struct {
+		elem *dom.Element
+
+		// matched has k, if steps[:k] matched with elem as last.
+		// pending has k, if steps[k] is descendant step, and
+		// steps[:k] matched with an ancestor of elem as last.
+		matched, pending []int
+
+		// match tells whether elem is selected by all steps.
+		// captured tells whether elem or its ancestor is
+		// selected, so that its children are kept.
+		match, captured bool
+	}
+	root := &entry{matched: []int{0}}
+	stack := []*entry{root}
+	decoder := xml.NewDecoder(r)
+	for {
+		t, err := decoder.RawToken()
+		if err == io.EOF {
+			if len(stack) > 1 {
+				return fmt.Errorf("expected </%s>", stack[len(stack)-1].elem.Name)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		top := stack[len(stack)-1]
+		switch t := t.(type) {
+		case xml.StartElement:
+			elem := new(dom.Element)
+			if top.elem != nil {
+				elem.SetParent(top.elem)
+			}
+			if err := streamElement(elem, t); err != nil {
+				return err
+			}
+			if top.captured {
+				_ = top.elem.Append(elem)
+			}
+			e := &entry{elem: elem, captured: top.captured}
+			for _, k := range merge(top.matched, top.pending) {
+				if k == len(x.steps) {
+					continue
+				}
+				step := x.steps[k]
+				if step.descendant {
+					e.pending = append(e.pending, k)
+				}
+				if step.test(elem) {
+					ok, err := step.matches(elem)
+					if err != nil {
+						return err
+					}
+					if ok {
+						e.matched = append(e.matched, k+1)
+					}
+				}
+			}
+			if n := len(e.matched); n > 0 && e.matched[n-1] == len(x.steps) {
+				e.match, e.captured = true, true
+			}
+			stack = append(stack, e)
+		case xml.EndElement:
+			if top.elem == nil || top.elem.Prefix != t.Name.Space || top.elem.Local != t.Name.Local {
+				return fmt.Errorf("unexpected </%s>", t.Name.Local)
+			}
+			stack = stack[:len(stack)-1]
+			if !top.match {
+				break
+			}
+			if !stack[len(stack)-1].captured {
+				detach(top.elem)
+			}
+			if !fn(top.elem) {
+				return nil
+			}
+		case xml.CharData:
+			if top.captured {
+				children := top.elem.Children()
+				if len(children) > 0 {
+					if text, ok := children[len(children)-1].(*dom.Text); ok {
+						text.Data += string(t)
+						break
+					}
+				}
+				_ = top.elem.Append(&dom.Text{Data: string(t)})
+			}
+		case xml.Comment:
+			if top.captured {
+				_ = top.elem.Append(&dom.Comment{Data: string(t)})
+			}
+		case xml.ProcInst:
+			if top.captured {
+				_ = top.elem.Append(&dom.ProcInst{Target: t.Target, Data: string(t.Inst)})
+			}
+		}
+	}
+}
+
+// matches tells whether elem satisfies all predicates of the step.
+func (s *streamStep) matches(elem *dom.Element) (bool, error) {
+	for _, p := range s.predicates {
+		r, err := p.Eval(elem, nil)
+		if err != nil || !Value2Boolean(r) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// streamElement populates elem with the name, attributes and
+// namespace declarations of t. The parent of elem must be set
+// to resolve prefixes.
+func streamElement(elem *dom.Element, t xml.StartElement) error {
+	for _, a := range t.Attr {
+		if a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns" {
+			if elem.NSDecl == nil {
+				elem.NSDecl = make(map[string]string)
+			}
+			if a.Name.Space == "" {
+				elem.NSDecl[""] = a.Value
+			} else {
+				elem.NSDecl[a.Name.Local] = a.Value
+			}
+		}
+	}
+	uri, ok := elem.ResolvePrefix(t.Name.Space)
+	if !ok {
+		return fmt.Errorf("unresolved prefix: %s", t.Name.Space)
+	}
+	elem.Name = &dom.Name{URI: uri, Prefix: t.Name.Space, Local: t.Name.Local}
+	for _, a := range t.Attr {
+		if a.Name.Space == "xmlns" || a.Name.Space == "" && a.Name.Local == "xmlns" {
+			continue
+		}
+		name := &dom.Name{Local: a.Name.Local}
+		if a.Name.Space != "" {
+			if name.URI, ok = elem.ResolvePrefix(a.Name.Space); !ok {
+				return fmt.Errorf("unresolved prefix: %s", a.Name.Space)
+			}
+			name.Prefix = a.Name.Space
+		}
+		elem.Attrs = append(elem.Attrs, &dom.Attr{Owner: elem, Name: name, Value: a.Value, Type: "CDATA"})
+	}
+	return nil
+}
+
+// detach removes the parent of elem, after declaring
+// the namespaces in scope, that are declared by ancestors.
+func detach(elem *dom.Element) {
+	for p, ok := elem.Parent().(*dom.Element); ok; p, ok = p.Parent().(*dom.Element) {
+		for prefix, uri := range p.NSDecl {
+			if _, ok := elem.NSDecl[prefix]; !ok {
+				if elem.NSDecl == nil {
+					elem.NSDecl = make(map[string]string)
+				}
+				elem.NSDecl[prefix] = uri
+			}
+		}
+	}
+	elem.SetParent(nil)
+}
+
+// merge returns the union of sorted slices a and b.
+func merge(a, b []int) []int {
+	if len(b) == 0 {
+		return a
+	}
+	if len(a) == 0 {
+		return b
+	}
+	r := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			r, a = append(r, a[0]), a[1:]
+		case a[0] > b[0]:
+			r, b = append(r, b[0]), b[1:]
+		default:
+			r, a, b = append(r, a[0]), a[1:], b[1:]
+		}
+	}
+	return append(append(r, a...), b...)
+}
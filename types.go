@@ -54,6 +54,15 @@ func TypeOf(v interface{}) DataType {
 	panic(InvalidValueError{v})
 }
 
+// nodeSet returns the given value as []dom.Node.
+// It panics with ConversionError, if the value is not a node-set.
+func nodeSet(v interface{}) []dom.Node {
+	if ns, ok := v.([]dom.Node); ok {
+		return ns
+	}
+	panic(ConversionError{TypeOf(v), NodeSet})
+}
+
 /************************************************************************/
 
 // Value2String converts given value to a string.
@@ -127,6 +136,46 @@ func Value2Boolean(v interface{}) bool {
 	panic(fmt.Sprintf("%T is not valid xpath data-type", v))
 }
 
+// TryValue2String is same as Value2String, but returns
+// InvalidValueError rather than panic, if the value is not
+// []dom.Node, string, float64 or boolean.
+func TryValue2String(v interface{}) (string, error) {
+	if err := checkValue(v); err != nil {
+		return "", err
+	}
+	return Value2String(v), nil
+}
+
+// TryValue2Number is same as Value2Number, but returns
+// InvalidValueError rather than panic, if the value is not
+// []dom.Node, string, float64 or boolean.
+func TryValue2Number(v interface{}) (float64, error) {
+	if err := checkValue(v); err != nil {
+		return 0, err
+	}
+	return Value2Number(v), nil
+}
+
+// TryValue2Boolean is same as Value2Boolean, but returns
+// InvalidValueError rather than panic, if the value is not
+// []dom.Node, string, float64 or boolean.
+func TryValue2Boolean(v interface{}) (bool, error) {
+	if err := checkValue(v); err != nil {
+		return false, err
+	}
+	return Value2Boolean(v), nil
+}
+
+// checkValue returns InvalidValueError, if v is not
+// a valid xpath value.
+func checkValue(v interface{}) error {
+	switch v.(type) {
+	case []dom.Node, string, float64, bool:
+		return nil
+	}
+	return InvalidValueError{v}
+}
+
 // Value2Expr returns literal Expr for given value.
 // The value must be string, float64 or bool.
 func Value2Expr(v interface{}) Expr {
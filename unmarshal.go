@@ -0,0 +1,180 @@
+// Copyright 2017 Santhosh Kumar Tekuri. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xpath
+
+import (
+	"math"
+	"reflect"
+	"sync"
+
+	"github.com/santhosh-tekuri/dom"
+)
+
+// EvalTo evaluates the compiled XPath expression in given context and stores
+// the resulting nodes in the value pointed to by out. If the result cannot be
+// converted to []dom.Node, returns ConversionError.
+//
+// The out must be a non-nil pointer to a struct, or to a slice of structs.
+// For a slice, a struct is appended for each node, in document order.
+// For a struct, only the first node is used, and the struct is left
+// unchanged if there are no nodes.
+//
+// Struct fields are populated using the xpath expression in their tag,
+// evaluated with the node as context node. Fields without tag are ignored.
+// The expressions are compiled with the options of Compiler, that compiled
+// this XPath. The compiled expressions are cached per struct type, for later
+// calls of EvalTo.
+//
+//	type Book struct {
+//		ID      string   `xpath:"@id"`
+//		Price   float64  `xpath:"price"`
+//		InStock bool     `xpath:"@stock > 0"`
+//		Authors []string `xpath:"author"`
+//		Reviews []Review `xpath:"reviews/review"`
+//	}
+//
+// The result of expression is converted to the field type as follows:
+//
+//	string, bool, float   string(), boolean(), number() of result
+//	int, uint             number() of result truncated, NaN gives 0
+//	struct                populated from first node of result
+//	[]struct              populated from each node of result
+//	[]string              string-value of each node of result
+//
+// Negative numbers give 0 for uint fields. Fields of any other type
+// return UnsupportedFieldError.
+//
+// The vars argument can be nil. It is used for all tag expressions.
+func (x *XPath) EvalTo(n dom.Node, vars Variables, out interface{}) error {
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return InvalidOutputError{reflect.TypeOf(out)}
+	}
+	v = v.Elem()
+	if v.Kind() != reflect.Struct && (v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct) {
+		return InvalidOutputError{reflect.TypeOf(out)}
+	}
+	u := &unmarshaller{x.tags, vars}
+	return u.set(v, x, n, reflect.StructField{})
+}
+
+// tagCompiler compiles the xpaths in struct tags for EvalTo.
+type tagCompiler struct {
+	// compiler is copy of the Compiler, that compiled the XPath.
+	compiler Compiler
+
+	mu    sync.Mutex
+	cache map[reflect.Type][]*XPath
+}
+
+// xpaths returns the compiled xpath of each field of struct type t.
+// It is nil for the fields, which are not populated.
+func (tc *tagCompiler) xpaths(t reflect.Type) ([]*XPath, error) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if xs, ok := tc.cache[t]; ok {
+		return xs, nil
+	}
+	xs := make([]*XPath, t.NumField())
+	for i := range xs {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("xpath")
+		if !ok || f.PkgPath != "" {
+			continue
+		}
+		x, err := tc.compiler.Compile(tag)
+		if err != nil {
+			return nil, err
+		}
+		xs[i] = x
+	}
+	if tc.cache == nil {
+		tc.cache = make(map[reflect.Type][]*XPath)
+	}
+	tc.cache[t] = xs
+	return xs, nil
+}
+
+type unmarshaller struct {
+	tags *tagCompiler
+	vars Variables
+}
+
+// set populates v, which is field f, by evaluating x with
+// context node n.
+func (u *unmarshaller) set(v reflect.Value, x *XPath, n dom.Node, f reflect.StructField) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := x.EvalString(n, u.vars)
+		v.SetString(s)
+		return err
+	case reflect.Bool:
+		b, err := x.EvalBoolean(n, u.vars)
+		v.SetBool(b)
+		return err
+	case reflect.Float32, reflect.Float64:
+		num, err := x.EvalNumber(n, u.vars)
+		v.SetFloat(num)
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, err := x.EvalNumber(n, u.vars)
+		if math.IsNaN(num) {
+			num = 0
+		}
+		v.SetInt(int64(num))
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		num, err := x.EvalNumber(n, u.vars)
+		if math.IsNaN(num) || num < 0 {
+			num = 0
+		}
+		v.SetUint(uint64(num))
+		return err
+	case reflect.Struct:
+		ns, err := x.EvalNodeSet(n, u.vars)
+		if err != nil || len(ns) == 0 {
+			return err
+		}
+		return u.fill(v, ns[0])
+	case reflect.Slice:
+		t := v.Type().Elem()
+		if t.Kind() != reflect.Struct && t.Kind() != reflect.String {
+			break
+		}
+		ns, err := x.EvalNodeSet(n, u.vars)
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), len(ns), len(ns))
+		for i, n := range ns {
+			if t.Kind() == reflect.String {
+				s.Index(i).SetString(Node2String(n))
+			} else if err := u.fill(s.Index(i), n); err != nil {
+				return err
+			}
+		}
+		v.Set(reflect.AppendSlice(v, s))
+		return nil
+	}
+	return UnsupportedFieldError{f.Name, f.Type}
+}
+
+// fill populates the tagged fields of struct v, with context node n.
+func (u *unmarshaller) fill(v reflect.Value, n dom.Node) error {
+	t := v.Type()
+	xs, err := u.tags.xpaths(t)
+	if err != nil {
+		return err
+	}
+	for i, x := range xs {
+		if x == nil {
+			continue
+		}
+		if err := u.set(v.Field(i), x, n, t.Field(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}